@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminURL          = "/admin/"
+	adminSessionsURL  = "/admin/sessions"
+	dftAdminPageSize  = 50  // sessions returned per page if no limit given
+	maxAdminPageSize  = 500 // maximum sessions returned per page
+	adminAuthScheme   = "Bearer "
+	adminExpireAction = "expire"
+)
+
+// AdminSession summarises a session in the admin session list
+type AdminSession struct {
+	SessionID          string      `json:"sessionId"`
+	WebsiteURL         string      `json:"websiteUrl"`
+	WebsiteURLHashCode interface{} `json:"websiteURLHashCode"` // as in our output (see urlHashCode)
+	Tenant             string      `json:"tenant,omitempty"`
+	FormID             string      `json:"formId,omitempty"`
+	Created            time.Time   `json:"created"`
+	LastActivity       time.Time   `json:"lastActivity"`
+	Pasted             bool        `json:"pasted"` // anything pasted into any field
+}
+
+// AdminSessionList is a page of the admin session list
+type AdminSessionList struct {
+	Total    int            `json:"total"` // number of sessions matching the filters
+	Offset   int            `json:"offset"`
+	Limit    int            `json:"limit"`
+	Sessions []AdminSession `json:"sessions"`
+}
+
+// adminFilter selects sessions in the admin session list
+type adminFilter struct {
+	website *string       // hash code of the website URL, as a decimal or hex string
+	minAge  time.Duration // (0 for no minimum)
+	maxAge  time.Duration // (0 for no maximum)
+	pasted  *bool         // sessions with (or without) anything pasted
+	offset  int           // first session returned
+	limit   int           // maximum sessions returned
+}
+
+// parseAdminFilter reads the filter and pagination from the list query parameters:
+//
+//	website	- websiteURLHashCode of the sessions' website, as in our output
+//	minAge	- minimum age of sessions (e.g. 30s, 10m)
+//	maxAge	- maximum age of sessions
+//	pasted	- true for sessions with anything pasted, false for those without
+//	offset	- index of the first session returned
+//	limit	- maximum number of sessions returned
+func parseAdminFilter(query url.Values) (*adminFilter, error) {
+	f := &adminFilter{limit: dftAdminPageSize}
+	var err error
+	if v := query.Get("website"); len(v) > 0 {
+		website := strings.ToLower(v)
+		if len(strings.TrimLeft(website, "0123456789abcdef")) > 0 {
+			return nil, fmt.Errorf("invalid website: %q", v)
+		}
+		f.website = &website
+	}
+	if v := query.Get("minAge"); len(v) > 0 {
+		if f.minAge, err = time.ParseDuration(v); err != nil || f.minAge < 0 {
+			return nil, fmt.Errorf("invalid minAge: %q", v)
+		}
+	}
+	if v := query.Get("maxAge"); len(v) > 0 {
+		if f.maxAge, err = time.ParseDuration(v); err != nil || f.maxAge < 0 {
+			return nil, fmt.Errorf("invalid maxAge: %q", v)
+		}
+	}
+	if v := query.Get("pasted"); len(v) > 0 {
+		pasted, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pasted: %q", v)
+		}
+		f.pasted = &pasted
+	}
+	if v := query.Get("offset"); len(v) > 0 {
+		if f.offset, err = strconv.Atoi(v); err != nil || f.offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %q", v)
+		}
+	}
+	if v := query.Get("limit"); len(v) > 0 {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit <= 0 || f.limit > maxAdminPageSize {
+			return nil, fmt.Errorf("invalid limit: %q (maximum %d)", v, maxAdminPageSize)
+		}
+	}
+	return f, nil
+}
+
+// match returns true if a session summary matches the filter
+func (f *adminFilter) match(s *AdminSession, now time.Time) bool {
+	age := now.Sub(s.Created)
+	switch {
+	case f.website != nil && fmt.Sprint(s.WebsiteURLHashCode) != *f.website:
+		return false
+	case f.minAge > 0 && age < f.minAge:
+		return false
+	case f.maxAge > 0 && age > f.maxAge:
+		return false
+	case f.pasted != nil && s.Pasted != *f.pasted:
+		return false
+	}
+	return true
+}
+
+// newAdminSession summarises a session, hashing its website as we do for our output
+func (s *Server) newAdminSession(info SessionInfo) AdminSession {
+	d := info.Data
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	session := AdminSession{
+		SessionID:          d.SessionID,
+		WebsiteURL:         d.WebsiteURL,
+		WebsiteURLHashCode: websiteHashCode(s.urlHash, s.stripQuery, d.WebsiteURL),
+		Tenant:             d.Tenant,
+		FormID:             d.FormID,
+		Created:            info.Created,
+		LastActivity:       info.LastActivity,
+	}
+	for _, record := range d.CopyAndPaste {
+		if record.Pastes > 0 {
+			session.Pasted = true
+		}
+	}
+	return session
+}
+
+// authorizeAdmin checks an admin request carries our admin key
+func (s *Server) authorizeAdmin(request *http.Request) bool {
+	auth := request.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, adminAuthScheme) {
+		return false
+	}
+	key := strings.TrimPrefix(auth, adminAuthScheme)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey)) == 1
+}
+
+// findSession returns a session without counting it as activity
+func (s *Server) findSession(sessionID string) (SessionInfo, bool) {
+	for _, info := range s.sessionMgr.Sessions() {
+		if info.Data.SessionID == sessionID {
+			return info, true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// writeJSON writes a JSON response
+func writeJSON(response http.ResponseWriter, status int, v interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(v)
+}
+
+// adminHandler processes admin API calls:
+//
+//	GET		/admin/sessions					- list sessions (see parseAdminFilter)
+//	GET		/admin/sessions/<id>			- a session's Data
+//	POST	/admin/sessions/<id>/expire	- expire a session (its data is output as for any other expired session)
+//	DELETE	/admin/sessions/<id>			- delete a session (without any output)
+//
+// All calls require an "Authorization: Bearer <admin key>" header. The API is disabled if no key is configured.
+func (s *Server) adminHandler(response http.ResponseWriter, request *http.Request) {
+	if len(s.adminKey) == 0 {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.authorizeAdmin(request) {
+		log.Printf("INFO: Unauthorised admin request from %s\n", request.RemoteAddr)
+		response.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if request.URL.Path == adminSessionsURL {
+		if request.Method != "GET" {
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.adminListSessions(response, request)
+		return
+	}
+	if !strings.HasPrefix(request.URL.Path, adminSessionsURL+"/") {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, adminSessionsURL+"/"), "/")
+	sid := parts[0]
+	switch {
+	case len(parts) == 1 && request.Method == "GET":
+		info, found := s.findSession(sid)
+		if !found {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		info.Data.mutex.Lock()
+		defer info.Data.mutex.Unlock()
+		writeJSON(response, http.StatusOK, info.Data)
+	case len(parts) == 1 && request.Method == "DELETE":
+		if _, found := s.findSession(sid); !found {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("INFO: Session deleted by admin: %s\n", sid)
+		s.sessionMgr.Delete(sid)
+		response.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == adminExpireAction && request.Method == "POST":
+		if !s.sessionMgr.Expire(sid) {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("INFO: Session expired by admin: %s\n", sid)
+		response.WriteHeader(http.StatusNoContent)
+	case len(parts) <= 2:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		response.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// adminListSessions returns a page of the sessions matching the filters, oldest first
+func (s *Server) adminListSessions(response http.ResponseWriter, request *http.Request) {
+	filter, err := parseAdminFilter(request.URL.Query())
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := timeNow()
+	var matched []AdminSession
+	for _, info := range s.sessionMgr.Sessions() {
+		if session := s.newAdminSession(info); filter.match(&session, now) {
+			matched = append(matched, session)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].Created.Equal(matched[j].Created) {
+			return matched[i].Created.Before(matched[j].Created)
+		}
+		return matched[i].SessionID < matched[j].SessionID
+	})
+
+	list := &AdminSessionList{Total: len(matched), Offset: filter.offset, Limit: filter.limit, Sessions: []AdminSession{}}
+	if filter.offset < len(matched) {
+		end := filter.offset + filter.limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		list.Sessions = matched[filter.offset:end]
+	}
+	writeJSON(response, http.StatusOK, list)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminTestServer returns a server with three sessions, created a minute apart, for testing the admin API.
+// Sessions expired are appended to expired.
+func adminTestServer(t *testing.T, expired *[]string) (*Server, []*Data) {
+	start := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	now := start
+	timeNow = func() time.Time { return now }
+
+	sm := CreateExpiringSessionManager(0, 0, func(d *Data) { *expired = append(*expired, d.SessionID) })
+	var sessions []*Data
+	for i, url := range []string{"http://a.com/index.html", "http://b.com/index.html", "http://a.com/index.html"} {
+		now = start.Add(time.Duration(i) * time.Minute)
+		d, err := sm.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.WebsiteURL = url
+		sessions = append(sessions, d)
+	}
+	sessions[1].CopyAndPaste["inputEmail"] = &ClipboardRecord{Pastes: 1}
+	sessions[2].CopyAndPaste["inputEmail"] = &ClipboardRecord{Copies: 1}
+	now = start.Add(5 * time.Minute)
+	return &Server{sessionMgr: sm, adminKey: "secret"}, sessions
+}
+
+// adminRequest makes an admin request with our test key
+func adminRequest(s *Server, method, url string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, url, nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response := httptest.NewRecorder()
+	s.adminHandler(response, request)
+	return response
+}
+
+func TestAdminListSessions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	defer func() { timeNow = time.Now }()
+	var expired []string
+	s, sessions := adminTestServer(t, &expired)
+
+	website := func(url string) string { return fmt.Sprint(HashString(url)) }
+	tests := []struct {
+		query    string
+		total    int
+		expected []*Data
+	}{
+		{"", 3, sessions},
+		{"?limit=2", 3, sessions[:2]},
+		{"?limit=2&offset=2", 3, sessions[2:]},
+		{"?offset=5", 3, nil},
+		{"?website=" + website("http://a.com/index.html"), 2, []*Data{sessions[0], sessions[2]}},
+		{"?website=" + website("http://c.com/index.html"), 0, nil},
+		{"?website=" + website("http://a.com/index.html") + "&pasted=true", 0, nil},
+		{"?pasted=true", 1, sessions[1:2]},
+		{"?pasted=false", 2, []*Data{sessions[0], sessions[2]}},
+		{"?minAge=4m", 2, sessions[:2]},
+		{"?maxAge=3m30s", 1, sessions[2:]},
+	}
+	for _, test := range tests {
+		response := adminRequest(s, "GET", "http://localhost/admin/sessions"+test.query)
+		if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Unexpected response for %q: %d %s", test.query, response.Code, response.Body.String())
+		}
+		list := &AdminSessionList{}
+		if err := json.NewDecoder(response.Body).Decode(list); err != nil {
+			t.Fatal(err)
+		}
+		if list.Total != test.total || len(list.Sessions) != len(test.expected) {
+			t.Errorf("Unexpected sessions for %q: expected %d of %d, got %+v", test.query, len(test.expected), test.total, list)
+			continue
+		}
+		for i, d := range test.expected {
+			if list.Sessions[i].SessionID != d.SessionID || list.Sessions[i].WebsiteURL != d.WebsiteURL {
+				t.Errorf("Unexpected session %d for %q: expected %s, got %+v", i, test.query, d.SessionID, list.Sessions[i])
+			}
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=501", "?offset=-1", "?minAge=soon", "?pasted=maybe", "?website=a.com"} {
+		if response := adminRequest(s, "GET", "http://localhost/admin/sessions"+query); response.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q: expected %d, got %d", query, http.StatusBadRequest, response.Code)
+		}
+	}
+
+	// the website filter uses the hash we're configured to output
+	s.urlHash, s.stripQuery = "fnv64a", true
+	sessions[2].WebsiteURL = "http://a.com/index.html?ref=mail"
+	hc := fmt.Sprint(websiteHashCode("fnv64a", true, "http://a.com/index.html"))
+	response := adminRequest(s, "GET", "http://localhost/admin/sessions?website="+strings.ToUpper(hc))
+	list := &AdminSessionList{}
+	if err := json.NewDecoder(response.Body).Decode(list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 2 || list.Sessions[0].WebsiteURLHashCode != hc || list.Sessions[1].WebsiteURLHashCode != hc {
+		t.Errorf("Unexpected sessions for 64 bit website hash %s: %+v", hc, list)
+	}
+}
+
+func TestAdminSession(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	defer func() { timeNow = time.Now }()
+	var expired []string
+	s, sessions := adminTestServer(t, &expired)
+	url := "http://localhost/admin/sessions/"
+
+	response := adminRequest(s, "GET", url+sessions[1].SessionID)
+	d := &Data{}
+	if response.Code != http.StatusOK || json.NewDecoder(response.Body).Decode(d) != nil ||
+		d.SessionID != sessions[1].SessionID || d.CopyAndPaste["inputEmail"].Pastes != 1 {
+		t.Errorf("Unexpected session data: %d %+v", response.Code, d)
+	}
+
+	if response := adminRequest(s, "POST", url+sessions[0].SessionID+"/expire"); response.Code != http.StatusNoContent {
+		t.Errorf("Failed to expire session: %d", response.Code)
+	}
+	if len(expired) != 1 || expired[0] != sessions[0].SessionID {
+		t.Errorf("Session not reported as expired: %v", expired)
+	}
+	if response := adminRequest(s, "DELETE", url+sessions[1].SessionID); response.Code != http.StatusNoContent {
+		t.Errorf("Failed to delete session: %d", response.Code)
+	}
+	if len(expired) != 1 || s.sessionMgr.Count() != 1 {
+		t.Errorf("Unexpected sessions after delete: %d (expired %v)", s.sessionMgr.Count(), expired)
+	}
+
+	tests := []struct {
+		method, path string
+		expected     int
+	}{
+		{"GET", sessions[0].SessionID, http.StatusNotFound},
+		{"DELETE", sessions[1].SessionID, http.StatusNotFound},
+		{"POST", sessions[1].SessionID + "/expire", http.StatusNotFound},
+		{"PUT", sessions[2].SessionID, http.StatusMethodNotAllowed},
+		{"GET", sessions[2].SessionID + "/expire", http.StatusMethodNotAllowed},
+		{"GET", sessions[2].SessionID + "/expire/now", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if response := adminRequest(s, test.method, url+test.path); response.Code != test.expected {
+			t.Errorf("Unexpected status for %s %s: expected %d, got %d", test.method, test.path, test.expected, response.Code)
+		}
+	}
+	if response := adminRequest(s, "POST", "http://localhost/admin/sessions"); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status for POST to session list: %d", response.Code)
+	}
+	if response := adminRequest(s, "GET", "http://localhost/admin/other"); response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status for unknown admin URL: %d", response.Code)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	defer func() { timeNow = time.Now }()
+	var expired []string
+	s, _ := adminTestServer(t, &expired)
+
+	for _, auth := range []string{"", "secret", "Bearer wrong", "Basic c2VjcmV0"} {
+		request := httptest.NewRequest("GET", "http://localhost/admin/sessions", nil)
+		request.Header.Set("Authorization", auth)
+		response := httptest.NewRecorder()
+		s.adminHandler(response, request)
+		if response.Code != http.StatusUnauthorized || !strings.HasPrefix(response.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("Unexpected response for Authorization %q: %d", auth, response.Code)
+		}
+	}
+
+	// no key disables the API altogether
+	s.adminKey = ""
+	if response := adminRequest(s, "GET", "http://localhost/admin/sessions"); response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status with admin API disabled: %d", response.Code)
+	}
+}
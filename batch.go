@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	maxBatchEvents = 500     // maximum number of events accepted in a single batch
+	maxBatchBytes  = 1 << 20 // maximum size of a batch request body
+)
+
+// BatchResult reports the outcome of a single event in a batch
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse is returned from a batch API call
+type BatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []BatchResult `json:"results"`
+}
+
+// decodeBatch reads the events from a batch request body.
+// The body may be either a JSON array of events or newline delimited JSON events.
+// Any events decoded before an error are returned along with the error.
+func decodeBatch(body io.Reader) ([]*PageEvent, error) {
+	reader := bufio.NewReader(body)
+	decoder := json.NewDecoder(reader)
+
+	// skip leading white space to see whether we have an array
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		reader.ReadByte()
+	}
+	b, _ := reader.Peek(1)
+	isArray := b[0] == '['
+	if isArray {
+		decoder.Token() // opening bracket
+	}
+
+	var events []*PageEvent
+	for decoder.More() {
+		if len(events) == maxBatchEvents {
+			return events, fmt.Errorf("too many events in batch (maximum %d)", maxBatchEvents)
+		}
+		event := &PageEvent{}
+		if err := decoder.Decode(event); err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+// processBatch applies each event in turn, as if each had been posted to the API separately
+func (s *Server) processBatch(request *http.Request, events []*PageEvent) *BatchResponse {
+	report := &BatchResponse{Results: make([]BatchResult, 0, len(events))}
+	for i, event := range events {
+		result := BatchResult{Index: i, Status: http.StatusOK}
+		if tenant, err := s.eventTenant(request, event); err != nil {
+			log.Printf("INFO: Event rejected: %v\n", err)
+			result.Status = http.StatusForbidden
+			result.Error = err.Error()
+		} else if data, err := s.lookupSession(event.SessionID, event.WebsiteURL); err != nil {
+			result.Status = http.StatusForbidden
+			result.Error = err.Error()
+		} else if throttled, retryAfter := s.throttleSession(event.SessionID, data); throttled {
+			log.Printf("INFO: Rate limit exceeded for session %s\n", event.SessionID)
+			result.Status = http.StatusTooManyRequests
+			result.Error = fmt.Sprintf("rate limit exceeded, retry after %d seconds", retrySeconds(retryAfter))
+		} else if status, err := s.applyEvent(tenant, event, data); err != nil {
+			log.Printf("ERROR: %v", err)
+			result.Status = status
+			result.Error = err.Error()
+		}
+		s.metrics.countEvent(event.EventType, result.Status)
+		if result.Status == http.StatusOK {
+			report.Accepted++
+		} else {
+			report.Rejected++
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// apiBatchHandler processes batched API calls
+func (s *Server) apiBatchHandler(response http.ResponseWriter, request *http.Request) {
+	defer s.metrics.requestHandled("apiBatch", time.Now())
+
+	if request.Method != "POST" {
+		log.Printf("ERROR: Invalid method type recieved in API: %s\n", request.Method)
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, retryAfter := s.ipLimiter.Allow(s.clientIP(request)); !ok {
+		log.Printf("INFO: Rate limit exceeded for %s\n", s.clientIP(request))
+		s.metrics.countEvent("", http.StatusTooManyRequests)
+		tooManyRequests(response, retryAfter)
+		return
+	}
+
+	events, decodeErr := decodeBatch(http.MaxBytesReader(response, request.Body, maxBatchBytes))
+	if decodeErr != nil && len(events) == 0 {
+		log.Printf("ERROR: Failed to decode request: %v\n", decodeErr)
+		s.metrics.countEvent("", http.StatusBadRequest)
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// apply everything we managed to decode, reporting any trailing decode error against the next event
+	report := s.processBatch(request, events)
+	if decodeErr != nil {
+		log.Printf("ERROR: Failed to decode request: %v\n", decodeErr)
+		report.Rejected++
+		report.Results = append(report.Results, BatchResult{
+			Index:  len(events),
+			Status: http.StatusBadRequest,
+			Error:  decodeErr.Error(),
+		})
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	json.NewEncoder(response).Encode(report)
+}
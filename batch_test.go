@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testBatchRequest posts a batch to a server with a single valid session and returns the decoded response
+func testBatchRequest(t *testing.T, body string, expectedStatus int) (*BatchResponse, *Data) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	data := dftTestData()
+	mockSM := &MockSessionManager{
+		t: t,
+		findFn: func(sessionID string) (*Data, bool) {
+			if sessionID != testSessionID {
+				return nil, false
+			}
+			return data, true
+		},
+	}
+	server := &Server{sessionMgr: mockSM}
+	server.Init()
+
+	response := httptest.NewRecorder()
+	server.apiBatchHandler(response, httptest.NewRequest("POST", "http://localhost/api/batch", strings.NewReader(body)))
+	resp := response.Result()
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("Unexpected status code for batch request: expected %d, got %d", expectedStatus, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, data
+	}
+	report := &BatchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		t.Fatalf("Failed to decode batch response: %v", err)
+	}
+	return report, data
+}
+
+// checkBatchStatuses ensures the report contains the expected status for each event
+func checkBatchStatuses(t *testing.T, report *BatchResponse, expected ...int) {
+	if len(report.Results) != len(expected) {
+		t.Fatalf("Unexpected number of batch results: expected %d, got %+v", len(expected), report.Results)
+	}
+	accepted := 0
+	for i, status := range expected {
+		if report.Results[i].Index != i || report.Results[i].Status != status {
+			t.Errorf("Unexpected batch result %d: expected status %d, got %+v", i, status, report.Results[i])
+		}
+		if status == http.StatusOK {
+			accepted++
+		}
+	}
+	if report.Accepted != accepted || report.Rejected != len(expected)-accepted {
+		t.Errorf("Unexpected batch totals: %d accepted, %d rejected", report.Accepted, report.Rejected)
+	}
+}
+
+func TestServerAPIBatchArray(t *testing.T) {
+	body := `[
+		{"eventType":"resize","oldWidth":500,"oldHeight":600,"newWidth":550,"newHeight":650,"sessionId":"` + testSessionID + `"},
+		{"eventType":"copyAndPaste","formId":"inputCVV","sessionId":"` + testSessionID + `"},
+		{"eventType":"timeTaken","time":9,"sessionId":"BADONE"},
+		{"eventType":"copyAndPaste","formId":"inputUnknown","sessionId":"` + testSessionID + `"},
+		{"eventType":"timeTaken","time":7,"sessionId":"` + testSessionID + `"}
+	]`
+	report, data := testBatchRequest(t, body, http.StatusOK)
+	checkBatchStatuses(t, report, http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusBadRequest, http.StatusOK)
+	if data.ResizeTo != (Dimension{550, 650}) || data.CopyAndPaste["inputCVV"] == nil || data.FormCompletionTime != 7 {
+		t.Errorf("Batch events not applied: %+v", data)
+	}
+}
+
+func TestServerAPIBatchNDJSON(t *testing.T) {
+	body := `{"eventType":"copyAndPaste","formId":"inputEmail","sessionId":"` + testSessionID + `"}` + "\n" +
+		`{"eventType":"timeTaken","time":3,"sessionId":"` + testSessionID + `"}` + "\n"
+	report, data := testBatchRequest(t, body, http.StatusOK)
+	checkBatchStatuses(t, report, http.StatusOK, http.StatusOK)
+	if data.CopyAndPaste["inputEmail"] == nil || data.FormCompletionTime != 3 {
+		t.Errorf("Batch events not applied: %+v", data)
+	}
+}
+
+func TestServerAPIBatchMalformed(t *testing.T) {
+	// events before the bad JSON are still applied
+	body := `{"eventType":"timeTaken","time":3,"sessionId":"` + testSessionID + `"}` + "\n" + `{"eventType":`
+	report, data := testBatchRequest(t, body, http.StatusOK)
+	checkBatchStatuses(t, report, http.StatusOK, http.StatusBadRequest)
+	if data.FormCompletionTime != 3 {
+		t.Errorf("Batch events not applied: %+v", data)
+	}
+
+	testBatchRequest(t, `not json`, http.StatusBadRequest)
+	testBatchRequest(t, `[{"eventType":"timeTaken"`, http.StatusBadRequest)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultPorts are the ports implied by each scheme, which are removed from canonical URLs
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+	"ftp":   "21",
+}
+
+// CanonicalURL returns the canonical form of a URL, so that URLs for the same page have the same hash code:
+//
+//   - the scheme and host are lowercased, and the port removed if it's the scheme's default
+//   - internationalised host names are Punycode encoded (e.g. bücher.de -> xn--bcher-kva.de)
+//   - an empty path becomes "/", and "." and ".." path segments are removed
+//   - percent-encoding is normalised: unreserved characters are decoded, anything else which
+//     must be encoded is encoded, and hex digits are uppercased
+//   - any user info and fragment are removed (neither is sent by browsers), as is the query if stripQuery is set
+//
+// URLs we can't parse, or without a scheme and host, are returned unchanged.
+func CanonicalURL(rawURL string, stripQuery bool) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return rawURL
+	}
+	scheme := strings.ToLower(u.Scheme)
+	var canonical strings.Builder
+	canonical.WriteString(scheme)
+	canonical.WriteString("://")
+	canonical.WriteString(canonicalHost(scheme, u.Host))
+
+	path := removeDotSegments(normalizeEscapes(u.EscapedPath(), false))
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonical.WriteString(path)
+	if !stripQuery && len(u.RawQuery) > 0 {
+		canonical.WriteByte('?')
+		canonical.WriteString(normalizeEscapes(u.RawQuery, true))
+	}
+	return canonical.String()
+}
+
+// canonicalHost returns a host (with optional port) lowercased, Punycode encoded, and without the scheme's default port
+func canonicalHost(scheme, hostPort string) string {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, "" // no port
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 address
+	} else {
+		host = punycodeHost(host)
+	}
+	if len(port) == 0 || port == defaultPorts[scheme] {
+		return host
+	}
+	return host + ":" + port
+}
+
+// isUnreserved returns true for characters which never need percent-encoding (RFC 3986 section 2.3)
+func isUnreserved(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// isPathChar returns true for characters allowed unencoded in a path (or a query, if query is set).
+// Reserved characters are left as they are, whether encoded or not, as encoding them may change their meaning.
+func isPathChar(c byte, query bool) bool {
+	return isUnreserved(c) || strings.IndexByte("!$&'()*+,;=:@/", c) >= 0 || (query && c == '?')
+}
+
+// unhex returns the value of a hex digit, or -1 if c isn't one
+func unhex(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
+
+// normalizeEscapes normalises the percent-encoding of an already escaped path or query
+func normalizeEscapes(s string, query bool) string {
+	const upperHex = "0123456789ABCDEF"
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' && i+2 < len(s) && unhex(s[i+1]) >= 0 && unhex(s[i+2]) >= 0 {
+			decoded := byte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			if isUnreserved(decoded) {
+				out.WriteByte(decoded)
+				continue
+			}
+			c = decoded // leave encoded
+		} else if isPathChar(c, query) {
+			out.WriteByte(c)
+			continue
+		}
+		out.WriteByte('%')
+		out.WriteByte(upperHex[c>>4])
+		out.WriteByte(upperHex[c&15])
+	}
+	return out.String()
+}
+
+// removeDotSegments removes "." and ".." segments from a path (RFC 3986 section 5.2.4)
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, segment)
+			continue
+		}
+		if last {
+			out = append(out, "") // keep the trailing slash
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// websiteHashCode returns the hash code we output for a website URL: the named hash (see urlHashCode)
+// of its canonical form
+func websiteHashCode(hashName string, stripQuery bool, websiteURL string) interface{} {
+	return urlHashCode(hashName, CanonicalURL(websiteURL, stripQuery))
+}
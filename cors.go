@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	corsAllowMethods  = "POST, OPTIONS"
+	corsAllowHeaders  = "Content-Type, " + apiKeyHeader + ", " + requestIDHeader
+	corsExposeHeaders = requestIDHeader + ", Retry-After"
+	corsMaxAge        = "600" // seconds browsers may cache a preflight response
+)
+
+// originListed returns true if an origin is in an allowlist ("*" allows any origin)
+func originListed(allowed []string, origin string) bool {
+	for _, next := range allowed {
+		if next == "*" || siteKey(next) == siteKey(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsAllowed returns true if a page with the given origin may call our API at all. This is all we can check
+// for a preflight request, before any event has been sent - each event is then checked by checkEventOrigin.
+func (s *Server) corsAllowed(origin string) bool {
+	if len(siteKey(origin)) == 0 {
+		return false
+	}
+	if s.tenants == nil {
+		// with no allowlist any site may post its own events
+		return len(s.allowedOrigins) == 0 || originListed(s.allowedOrigins, origin)
+	}
+	if t := s.tenants.Lookup(origin); t != nil && t.originAllowed(origin) {
+		return true
+	}
+	for _, t := range s.tenants.Tenants() {
+		if originListed(t.AllowedOrigins, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEventOrigin checks an event posted from a browser came from a page on the website it claims to be for,
+// or from an origin in that website's allowlist. Opaque origins (e.g. "null") and unparseable website URLs never match.
+func (s *Server) checkEventOrigin(request *http.Request, tenant *Tenant, event *PageEvent) error {
+	origin := request.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil // not sent by a browser
+	}
+	key := siteKey(origin)
+	if len(key) == 0 {
+		return fmt.Errorf("origin %s is not a website", origin)
+	}
+	if key == siteKey(event.WebsiteURL) {
+		return nil // sent from the same site
+	}
+	allowed := s.allowedOrigins
+	if tenant != nil {
+		allowed = tenant.AllowedOrigins
+	}
+	if !originListed(allowed, origin) {
+		return fmt.Errorf("origin %s does not match website %s", origin, event.WebsiteURL)
+	}
+	return nil
+}
+
+// cors wraps an API handler to respond to CORS preflight requests, and to allow browsers to read the
+// responses to requests from the origins we accept
+func (s *Server) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		response.Header().Add("Vary", "Origin")
+		preflight := request.Method == "OPTIONS" && len(request.Header.Get("Access-Control-Request-Method")) > 0
+		if len(origin) == 0 || !s.corsAllowed(origin) {
+			if preflight {
+				response.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next(response, request) // events from disallowed origins are rejected by checkEventOrigin
+			return
+		}
+
+		response.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			response.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			next(response, request)
+			return
+		}
+		if method := request.Header.Get("Access-Control-Request-Method"); method != "POST" {
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		response.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		response.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		response.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		response.WriteHeader(http.StatusNoContent)
+	}
+}
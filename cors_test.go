@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corsTestServer returns a server with a single session, optionally with the test tenants
+func corsTestServer(t *testing.T, withTenants bool, allowedOrigins ...string) *Server {
+	data := dftTestData()
+	server := &Server{
+		sessionMgr: &MockSessionManager{t: t, findFn: func(string) (*Data, bool) { return data, true }},
+		Middleware: []Middleware{},
+	}
+	server.allowedOrigins = allowedOrigins
+	if withTenants {
+		tenants, err := LoadTenantRegistry(filepath.Join("testdata", "tenants.json"), SinkConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.tenants = tenants
+	}
+	server.Init()
+	return server
+}
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		tenants bool
+		allowed []string
+		origin  string
+		method  string
+		status  int
+	}{
+		{false, nil, "https://any.example.com", "POST", http.StatusNoContent},
+		{false, nil, "https://any.example.com", "DELETE", http.StatusMethodNotAllowed},
+		{false, nil, "not a url", "POST", http.StatusForbidden},
+		{false, []string{"https://a.example.com"}, "https://a.example.com", "POST", http.StatusNoContent},
+		{false, []string{"https://a.example.com"}, "https://b.example.com", "POST", http.StatusForbidden},
+		{false, []string{"*"}, "https://b.example.com", "POST", http.StatusNoContent},
+		{true, nil, "https://shop.example.com", "POST", http.StatusNoContent},
+		{true, nil, "https://checkout.example.com", "POST", http.StatusNoContent}, // in shop's allowlist
+		{true, nil, "http://localhost:8080", "POST", http.StatusNoContent},
+		{true, nil, "https://evil.example.com", "POST", http.StatusForbidden}, // default tenant is only for its own site
+	}
+	for _, test := range tests {
+		server := corsTestServer(t, test.tenants, test.allowed...)
+		for _, url := range []string{"http://localhost/api", "http://localhost/api/batch"} {
+			request := httptest.NewRequest("OPTIONS", url, nil)
+			request.Header.Set("Origin", test.origin)
+			request.Header.Set("Access-Control-Request-Method", test.method)
+			request.Header.Set("Access-Control-Request-Headers", "content-type,x-api-key")
+			response := httptest.NewRecorder()
+			server.Handler().ServeHTTP(response, request)
+
+			header := response.Header()
+			if response.Code != test.status || header.Get("Vary") != "Origin" {
+				t.Errorf("Unexpected preflight response for %+v: %d %v", test, response.Code, header)
+			}
+			if allowed := header.Get("Access-Control-Allow-Origin"); (allowed == test.origin) != (test.status != http.StatusForbidden) {
+				t.Errorf("Unexpected Access-Control-Allow-Origin for %+v: %q", test, allowed)
+			}
+			if test.status == http.StatusNoContent && (header.Get("Access-Control-Allow-Methods") != corsAllowMethods ||
+				!strings.Contains(header.Get("Access-Control-Allow-Headers"), apiKeyHeader) ||
+				header.Get("Access-Control-Max-Age") != corsMaxAge) {
+				t.Errorf("Missing preflight headers for %+v: %v", test, header)
+			}
+		}
+	}
+}
+
+func TestCORSEventOrigin(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tests := []struct {
+		tenants    bool
+		allowed    []string
+		origin     string
+		websiteURL string
+		apiKey     string
+		status     int
+	}{
+		{false, nil, "", "https://a.example.com/index.html", "", http.StatusOK},
+		{false, nil, "https://a.example.com", "https://a.example.com/index.html", "", http.StatusOK},
+		{false, nil, "https://A.example.com:443", "https://a.example.com:443/form", "", http.StatusOK},
+		{false, nil, "https://b.example.com", "https://a.example.com/index.html", "", http.StatusForbidden},
+		{false, nil, "http://a.example.com", "https://a.example.com/index.html", "", http.StatusForbidden},
+		{false, nil, "null", "", "", http.StatusForbidden},
+		{false, nil, "null", "https://a.example.com/index.html", "", http.StatusForbidden},
+		{false, nil, "https://a.example.com", "", "", http.StatusForbidden},
+		{false, []string{"https://b.example.com"}, "https://b.example.com", "https://a.example.com/index.html", "", http.StatusOK},
+		{false, []string{"https://b.example.com"}, "https://c.example.com", "https://a.example.com/index.html", "", http.StatusForbidden},
+		{true, nil, "https://checkout.example.com", "https://shop.example.com/basket", "shop-site-key", http.StatusOK},
+		{true, nil, "https://blog.example.com", "https://shop.example.com/basket", "shop-site-key", http.StatusForbidden},
+		{true, nil, "http://localhost:8080", "http://localhost:8080/index.html", "", http.StatusOK},
+		{true, nil, "http://localhost:8080", "http://unknown.example.com/index.html", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		server := corsTestServer(t, test.tenants, test.allowed...)
+		body := `{"eventType":"timeTaken","time":5,"sessionId":"` + testSessionID + `","websiteUrl":"` + test.websiteURL + `"}`
+		request := httptest.NewRequest("POST", "http://localhost/api", strings.NewReader(body))
+		if len(test.origin) > 0 {
+			request.Header.Set("Origin", test.origin)
+		}
+		if len(test.apiKey) > 0 {
+			request.Header.Set(apiKeyHeader, test.apiKey)
+		}
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("Unexpected status for %+v: %d", test, response.Code)
+		}
+		if test.status == http.StatusOK && len(test.origin) > 0 && response.Header().Get("Access-Control-Allow-Origin") != test.origin {
+			t.Errorf("Response for %+v not readable by origin: %v", test, response.Header())
+		}
+	}
+}
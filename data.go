@@ -2,40 +2,331 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"io"
 	"sync"
+	"time"
 )
 
 // Dimension represents a pages dimensions
 type Dimension struct {
-	Width  int
-	Height int
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// orientation returns 1 if the dimension is wider than it is high (landscape), -1 if it's higher than
+// it is wide (portrait) or 0 if it's square (neither)
+func (dim Dimension) orientation() int {
+	switch {
+	case dim.Width > dim.Height:
+		return 1
+	case dim.Width < dim.Height:
+		return -1
+	}
+	return 0
+}
+
+// ResizeEvent records a single resize of the page
+type ResizeEvent struct {
+	From Dimension `json:"from"`
+	To   Dimension `json:"to"`
+	Time time.Time `json:"time"` // time the server received the event
+}
+
+// ResizeStats summarises the resize history of a page
+type ResizeStats struct {
+	Count            int       `json:"count"`
+	MinViewport      Dimension `json:"minViewport"`      // smallest width and height seen
+	MaxViewport      Dimension `json:"maxViewport"`      // largest width and height seen
+	OrientationFlips int       `json:"orientationFlips"` // changes between portrait and landscape
+}
+
+// ClipboardRecord records the clipboard activity for a single form field
+type ClipboardRecord struct {
+	Copies       int       `json:"copies"`
+	Cuts         int       `json:"cuts"`
+	Pastes       int       `json:"pastes"`
+	PastedLength int       `json:"pastedLength"` // total number of characters pasted
+	First        time.Time `json:"first"`        // time of the first clipboard event
+	Last         time.Time `json:"last"`         // time of the latest clipboard event
+}
+
+// completionTimeTolerance is the allowed difference between client and server form completion times.
+// The client reports whole seconds and events take time to reach us so we can't expect an exact match.
+const completionTimeTolerance = 2 * time.Second
+
+// SessionTiming records when the server saw each stage of a session
+type SessionTiming struct {
+	Created        time.Time `json:"created"`        // session created (page served)
+	FirstEvent     time.Time `json:"firstEvent"`     // first event received
+	FirstKeystroke time.Time `json:"firstKeystroke"` // first keystroke event received
+	Posted         time.Time `json:"posted"`         // form posted
+}
+
+// maxKeystrokeIntervals is the most intervals we accept in a single keystrokes event
+const maxKeystrokeIntervals = 1000
+
+// maxKeystrokeInterval is the longest time between keystrokes we accept (milliseconds), no session lasting longer
+const maxKeystrokeInterval = int(dftMaxLifetime / time.Millisecond)
+
+// TypingProfile summarises how a user typed into a single form field.
+// Only the timing of keystrokes is recorded, never the keys themselves.
+type TypingProfile struct {
+	Keystrokes     int     `json:"keystrokes"`
+	Backspaces     int     `json:"backspaces"`
+	MeanInterval   float64 `json:"meanIntervalMs"`     // mean time between keystrokes
+	Variance       float64 `json:"intervalVariance"`   // variance of the time between keystrokes (ms squared)
+	KeysPerSecond  float64 `json:"keysPerSecond"`      // typing speed
+	BackspaceRatio float64 `json:"backspaceRatio"`     // backspaces / keystrokes
+	PastedRatio    float64 `json:"pastedRatio"`        // pasted characters / (pasted + typed characters)
+	Intervals      int     `json:"intervals"`          // number of intervals received
+	IntervalSum    float64 `json:"intervalSum"`        // sum of intervals (ms)
+	IntervalSumSq  float64 `json:"intervalSumSquares"` // sum of squared intervals
+}
+
+// update recalculates the derived statistics, given the number of characters pasted into the field
+func (p *TypingProfile) update(pastedLength int) {
+	if p.Intervals > 0 {
+		n := float64(p.Intervals)
+		p.MeanInterval = p.IntervalSum / n
+		p.Variance = p.IntervalSumSq/n - p.MeanInterval*p.MeanInterval
+		if p.Variance < 0 {
+			p.Variance = 0 // rounding
+		}
+	}
+	if p.IntervalSum > 0 {
+		p.KeysPerSecond = float64(p.Intervals) * 1000 / p.IntervalSum
+	}
+	if p.Keystrokes > 0 {
+		p.BackspaceRatio = float64(p.Backspaces) / float64(p.Keystrokes)
+	}
+	// keystrokes include backspaces, each of which also removes a typed character
+	typed := p.Keystrokes - 2*p.Backspaces
+	if typed < 0 {
+		typed = 0
+	}
+	if pastedLength+typed > 0 {
+		p.PastedRatio = float64(pastedLength) / float64(pastedLength+typed)
+	}
 }
 
 // Data represents the data we want to capture from a users interaction with the page
 type Data struct {
-	WebsiteURL         string
-	SessionID          string
-	ResizeFrom         Dimension
-	ResizeTo           Dimension
-	CopyAndPaste       map[string]bool // map[fieldId]true
-	FormCompletionTime int             // Seconds
+	WebsiteURL         string                      `json:"websiteUrl"`
+	SessionID          string                      `json:"sessionId"`
+	Tenant             string                      `json:"tenant,omitempty"`   // tenant the session was issued for
+	FormID             string                      `json:"formId,omitempty"`   // form the session was issued for
+	ResizeFrom         Dimension                   `json:"resizeFrom"`         // size before the first resize
+	ResizeTo           Dimension                   `json:"resizeTo"`           // size after the latest resize
+	Resizes            []ResizeEvent               `json:"resizes,omitempty"`  // all resizes in the order received
+	CopyAndPaste       map[string]*ClipboardRecord `json:"copyAndPaste"`       // map[fieldId]record
+	FormCompletionTime int                         `json:"formCompletionTime"` // Seconds (as reported by the client)
+	Typing             map[string]*TypingProfile   `json:"typing,omitempty"`   // map[fieldId]profile
+
+	Timing                 SessionTiming   `json:"timing"`
+	ServerCompletionTime   int64           `json:"serverCompletionTimeMs,omitempty"` // Milliseconds from first keystroke to form post
+	TimeTakenReceived      bool            `json:"timeTakenReceived,omitempty"`      // client has reported FormCompletionTime
+	CompletionTimeMismatch bool            `json:"completionTimeMismatch,omitempty"` // client time doesn't match the server's
+	ThrottledEvents        int             `json:"throttledEvents,omitempty"`        // events rejected by the session's rate limit
+	Risk                   *RiskAssessment `json:"risk,omitempty"`                   // assessed once the form is posted
 
 	mutex sync.Mutex // need to sync access as could have concurrent api calls
 }
 
-// PrintUpdate writes the current user data to the supplied File
-func (d *Data) PrintUpdate(o *os.File, updateType string) {
-	fmt.Fprintf(o, "User Data Updated: %s\n", updateType)
-	fmt.Fprintf(o, "  WebsiteURL: %s\n", d.WebsiteURL)
-	fmt.Fprintf(o, "  SessionID: %s\n", d.SessionID)
-	fmt.Fprintf(o, "  ResizeFrom: (%d,%d)\n", d.ResizeFrom.Width, d.ResizeFrom.Height)
-	fmt.Fprintf(o, "  ResizeTo: (%d,%d)\n", d.ResizeTo.Width, d.ResizeTo.Height)
-	fmt.Fprintf(o, "  copyAndPaste controls:")
-	for next := range d.CopyAndPaste {
-		fmt.Fprintf(o, " %s", next)
-	}
-	fmt.Fprintf(o, "\n")
-	fmt.Fprintf(o, "  FormCompletionTime: %d seconds\n", d.FormCompletionTime)
-	fmt.Fprintf(o, "  websiteURLHashCode: %v\n", HashString(d.WebsiteURL))
+// newData returns a new, empty Data for the given session
+func newData(sessionID string) *Data {
+	d := &Data{SessionID: sessionID}
+	d.init()
+	return d
+}
+
+// init allocates any nil maps (e.g. after the Data is decoded from JSON)
+func (d *Data) init() {
+	if d.CopyAndPaste == nil {
+		d.CopyAndPaste = make(map[string]*ClipboardRecord)
+	}
+	if d.Typing == nil {
+		d.Typing = make(map[string]*TypingProfile)
+	}
+}
+
+// PrintUpdate writes the current user data to the supplied Writer in our default text format
+func (d *Data) PrintUpdate(o io.Writer, updateType string) {
+	TextFormatter{}.Format(o, d, updateType)
+}
+
+// applyEvent updates the data with the supplied event.
+// The caller must hold the data's mutex and is responsible for validating the event.
+func (d *Data) applyEvent(event *PageEvent) error {
+	switch event.EventType {
+	case "resize":
+		d.SessionID = event.SessionID
+		resize := ResizeEvent{
+			From: Dimension{Width: event.OldWidth, Height: event.OldHeight},
+			To:   Dimension{Width: event.NewWidth, Height: event.NewHeight},
+			Time: event.Received,
+		}
+		if len(d.Resizes) == 0 {
+			d.ResizeFrom = resize.From
+		}
+		d.ResizeTo = resize.To
+		d.Resizes = append(d.Resizes, resize)
+
+	case "copyAndPaste":
+		action := event.Action
+		if len(action) == 0 {
+			// older clients only tell us whether it was a paste
+			action = "copy"
+			if event.Pasted {
+				action = "paste"
+			}
+		}
+		record := d.CopyAndPaste[event.FormID]
+		if record == nil {
+			record = &ClipboardRecord{First: event.Received}
+		}
+		switch action {
+		case "copy":
+			record.Copies++
+		case "cut":
+			record.Cuts++
+		case "paste":
+			record.Pastes++
+			record.PastedLength += event.Length
+		default:
+			return fmt.Errorf("unexpected clipboard action: %s", action)
+		}
+		record.Last = event.Received
+		d.CopyAndPaste[event.FormID] = record
+		if action == "paste" {
+			d.typingProfile(event.FormID).update(record.PastedLength)
+		}
+
+	case "timeTaken":
+		d.FormCompletionTime = event.Time
+		d.TimeTakenReceived = true
+
+	case "firstKeystroke":
+		d.recordFirstKeystroke(event.Received)
+
+	case "keystrokes":
+		if len(event.Intervals) > maxKeystrokeIntervals {
+			return fmt.Errorf("too many keystroke intervals: %d", len(event.Intervals))
+		}
+		if event.Keys < 0 || event.Backspaces < 0 || event.Backspaces > event.Keys {
+			return fmt.Errorf("invalid keystroke counts: %d keys, %d backspaces", event.Keys, event.Backspaces)
+		}
+		var elapsed time.Duration
+		for _, interval := range event.Intervals {
+			if interval < 0 || interval > maxKeystrokeInterval {
+				return fmt.Errorf("invalid keystroke interval: %d", interval)
+			}
+			elapsed += time.Duration(interval) * time.Millisecond
+		}
+		// the intervals come from the client, so never believe typing started before the page was served
+		first := event.Received.Add(-elapsed)
+		if first.Before(d.Timing.Created) {
+			first = d.Timing.Created
+		}
+		d.recordFirstKeystroke(first)
+
+		profile := d.typingProfile(event.FormID)
+		profile.Keystrokes += event.Keys
+		profile.Backspaces += event.Backspaces
+		for _, interval := range event.Intervals {
+			profile.Intervals++
+			profile.IntervalSum += float64(interval)
+			profile.IntervalSumSq += float64(interval) * float64(interval)
+		}
+		pasted := 0
+		if record := d.CopyAndPaste[event.FormID]; record != nil {
+			pasted = record.PastedLength
+		}
+		profile.update(pasted)
+
+	default:
+		return fmt.Errorf("unexpected EventType: %s", event.EventType)
+	}
+	d.WebsiteURL = event.WebsiteURL
+	if d.Timing.FirstEvent.IsZero() {
+		d.Timing.FirstEvent = event.Received
+	}
+	return nil
+}
+
+// typingProfile returns the typing profile for a field, creating it if required
+func (d *Data) typingProfile(fieldID string) *TypingProfile {
+	profile := d.Typing[fieldID]
+	if profile == nil {
+		profile = &TypingProfile{}
+		d.Typing[fieldID] = profile
+	}
+	return profile
+}
+
+// recordFirstKeystroke records the time of the first keystroke (if not already known)
+func (d *Data) recordFirstKeystroke(t time.Time) {
+	if d.Timing.FirstKeystroke.IsZero() {
+		d.Timing.FirstKeystroke = t
+	}
+}
+
+// formPosted records the time the form was posted and calculates our own completion time,
+// flagging it if the client reported a different time.
+// There's nothing to compare if the client never reported its time.
+// The caller must hold the data's mutex.
+func (d *Data) formPosted(t time.Time) {
+	d.Timing.Posted = t
+	reported := time.Duration(d.FormCompletionTime) * time.Second
+	if !d.Timing.FirstKeystroke.IsZero() {
+		elapsed := t.Sub(d.Timing.FirstKeystroke)
+		d.ServerCompletionTime = int64(elapsed / time.Millisecond)
+		if d.TimeTakenReceived {
+			diff := reported - elapsed
+			d.CompletionTimeMismatch = diff > completionTimeTolerance || diff < -completionTimeTolerance
+		}
+	} else if d.TimeTakenReceived && !d.Timing.Created.IsZero() {
+		// we never saw any typing so can only check the client's time was possible at all
+		d.CompletionTimeMismatch = reported > t.Sub(d.Timing.Created)+completionTimeTolerance
+	}
+}
+
+// ResizeStats calculates summary statistics for the resize history.
+// The caller must hold the data's mutex.
+func (d *Data) ResizeStats() ResizeStats {
+	stats := ResizeStats{Count: len(d.Resizes)}
+	if stats.Count == 0 {
+		return stats
+	}
+	stats.MinViewport = d.Resizes[0].From
+	stats.MaxViewport = d.Resizes[0].From
+	update := func(dim Dimension) {
+		if dim.Width < stats.MinViewport.Width {
+			stats.MinViewport.Width = dim.Width
+		}
+		if dim.Height < stats.MinViewport.Height {
+			stats.MinViewport.Height = dim.Height
+		}
+		if dim.Width > stats.MaxViewport.Width {
+			stats.MaxViewport.Width = dim.Width
+		}
+		if dim.Height > stats.MaxViewport.Height {
+			stats.MaxViewport.Height = dim.Height
+		}
+	}
+
+	// a square viewport keeps the previous orientation, so only changes between portrait and landscape count
+	orientation := d.Resizes[0].From.orientation()
+	for _, r := range d.Resizes {
+		update(r.From)
+		update(r.To)
+		next := r.To.orientation()
+		if next == 0 {
+			continue
+		}
+		if orientation != 0 && next != orientation {
+			stats.OrientationFlips++
+		}
+		orientation = next
+	}
+	return stats
 }
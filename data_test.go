@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDataResizeHistory(t *testing.T) {
+	d := newData(testSessionID)
+	if stats := d.ResizeStats(); stats != (ResizeStats{}) {
+		t.Errorf("Unexpected stats with no resizes: %+v", stats)
+	}
+
+	start := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	resizes := []PageEvent{
+		{OldWidth: 800, OldHeight: 600, NewWidth: 600, NewHeight: 600},  // landscape -> square: no flip
+		{OldWidth: 600, OldHeight: 600, NewWidth: 400, NewHeight: 700},  // (landscape) -> portrait: flip
+		{OldWidth: 400, OldHeight: 700, NewWidth: 1024, NewHeight: 500}, // portrait -> landscape: flip
+	}
+	for i, event := range resizes {
+		event.EventType = "resize"
+		event.SessionID = testSessionID
+		event.Received = start.Add(time.Duration(i) * time.Second)
+		if err := d.applyEvent(&event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(d.Resizes) != 3 || d.Resizes[1].To != (Dimension{400, 700}) || !d.Resizes[2].Time.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Unexpected resize history: %+v", d.Resizes)
+	}
+	if d.ResizeFrom != (Dimension{800, 600}) || d.ResizeTo != (Dimension{1024, 500}) {
+		t.Errorf("Unexpected ResizeFrom/ResizeTo: %v, %v", d.ResizeFrom, d.ResizeTo)
+	}
+	expected := ResizeStats{
+		Count:            3,
+		MinViewport:      Dimension{400, 500},
+		MaxViewport:      Dimension{1024, 700},
+		OrientationFlips: 2,
+	}
+	if stats := d.ResizeStats(); stats != expected {
+		t.Errorf("Unexpected resize stats: expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestDataOrientationFlipsSquare(t *testing.T) {
+	tests := []struct {
+		resizes  []PageEvent
+		expected int
+	}{
+		// portrait -> square -> portrait: square keeps the previous orientation
+		{[]PageEvent{{OldWidth: 400, OldHeight: 700, NewWidth: 600, NewHeight: 600},
+			{OldWidth: 600, OldHeight: 600, NewWidth: 500, NewHeight: 800}}, 0},
+		// square -> landscape: no previous orientation
+		{[]PageEvent{{OldWidth: 600, OldHeight: 600, NewWidth: 800, NewHeight: 600}}, 0},
+		// square -> landscape -> square -> portrait
+		{[]PageEvent{{OldWidth: 600, OldHeight: 600, NewWidth: 800, NewHeight: 600},
+			{OldWidth: 800, OldHeight: 600, NewWidth: 700, NewHeight: 700},
+			{OldWidth: 700, OldHeight: 700, NewWidth: 400, NewHeight: 700}}, 1},
+	}
+	for i, test := range tests {
+		d := newData(testSessionID)
+		for _, event := range test.resizes {
+			event.EventType = "resize"
+			if err := d.applyEvent(&event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if flips := d.ResizeStats().OrientationFlips; flips != test.expected {
+			t.Errorf("Unexpected orientation flips for test %d: expected %d, got %d", i, test.expected, flips)
+		}
+	}
+}
+
+func TestDataClipboard(t *testing.T) {
+	d := newData(testSessionID)
+
+	start := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	events := []PageEvent{
+		{FormID: "inputEmail", Pasted: false},                    // legacy copy
+		{FormID: "inputEmail", Pasted: true},                     // legacy paste
+		{FormID: "inputEmail", Action: "cut"},                    // cut
+		{FormID: "inputCardNumber", Action: "paste", Length: 16}, // pastes with lengths
+		{FormID: "inputCardNumber", Action: "paste", Length: 3},
+	}
+	for i, event := range events {
+		event.EventType = "copyAndPaste"
+		event.Received = start.Add(time.Duration(i) * time.Second)
+		if err := d.applyEvent(&event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]ClipboardRecord{
+		"inputEmail":      {Copies: 1, Cuts: 1, Pastes: 1, First: start, Last: start.Add(2 * time.Second)},
+		"inputCardNumber": {Pastes: 2, PastedLength: 19, First: start.Add(3 * time.Second), Last: start.Add(4 * time.Second)},
+	}
+	if len(d.CopyAndPaste) != len(expected) {
+		t.Errorf("Unexpected clipboard records: %v", d.CopyAndPaste)
+	}
+	for field, record := range expected {
+		if r := d.CopyAndPaste[field]; r == nil || *r != record {
+			t.Errorf("Unexpected clipboard record for %s: expected %+v, got %+v", field, record, r)
+		}
+	}
+
+	if err := d.applyEvent(&PageEvent{EventType: "copyAndPaste", FormID: "inputCVV", Action: "drag"}); err == nil {
+		t.Errorf("Expected error for unknown clipboard action")
+	}
+}
+
+func TestDataServerTiming(t *testing.T) {
+	created := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	tests := []struct {
+		keystroke    time.Duration // from creation (0 for none)
+		posted       time.Duration // from creation
+		reported     int           // seconds (from client, -1 for no timeTaken event)
+		expectedTime int64         // milliseconds
+		mismatch     bool
+	}{
+		{5 * time.Second, 15500 * time.Millisecond, 10, 10500, false}, // client rounds down
+		{5 * time.Second, 15500 * time.Millisecond, 11, 10500, false}, // client rounds up
+		{5 * time.Second, 15500 * time.Millisecond, 60, 10500, true},  // client claims longer
+		{5 * time.Second, 15500 * time.Millisecond, 1, 10500, true},   // client claims shorter
+		{0, 15 * time.Second, 14, 0, false},                           // possible with no keystrokes seen
+		{0, 15 * time.Second, 30, 0, true},                            // longer than the page was loaded
+		{5 * time.Second, 15500 * time.Millisecond, -1, 10500, false}, // keystrokes seen but client never reported its time
+		{0, 15 * time.Second, -1, 0, false},                           // nothing seen at all
+	}
+	for _, test := range tests {
+		d := newData(testSessionID)
+		d.Timing.Created = created
+		if test.reported >= 0 {
+			d.applyEvent(&PageEvent{EventType: "timeTaken", Time: test.reported, Received: created.Add(test.posted)})
+		}
+		if test.keystroke > 0 {
+			d.applyEvent(&PageEvent{EventType: "firstKeystroke", Received: created.Add(test.keystroke)})
+			d.applyEvent(&PageEvent{EventType: "firstKeystroke", Received: created.Add(test.keystroke + time.Second)})
+		}
+		d.formPosted(created.Add(test.posted))
+
+		if d.ServerCompletionTime != test.expectedTime || d.CompletionTimeMismatch != test.mismatch {
+			t.Errorf("Unexpected completion time for %+v: got %dms (mismatch %v)", test, d.ServerCompletionTime, d.CompletionTimeMismatch)
+		}
+		if test.reported >= 0 && !d.Timing.FirstEvent.Equal(created.Add(test.posted)) {
+			t.Errorf("Unexpected first event time: %v", d.Timing.FirstEvent)
+		}
+		if test.keystroke > 0 && !d.Timing.FirstKeystroke.Equal(created.Add(test.keystroke)) {
+			t.Errorf("Unexpected first keystroke time: %v", d.Timing.FirstKeystroke)
+		}
+	}
+}
+
+func TestDataKeystrokes(t *testing.T) {
+	d := newData(testSessionID)
+	received := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+
+	events := []PageEvent{
+		{FormID: "inputEmail", Keys: 4, Intervals: []int{100, 200, 300}},
+		{FormID: "inputEmail", Keys: 4, Backspaces: 1, Intervals: []int{400}},
+		{FormID: "inputCVV", Keys: 2, Intervals: []int{50}},
+	}
+	for _, event := range events {
+		event.EventType = "keystrokes"
+		event.Received = received
+		if err := d.applyEvent(&event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// now paste into the CVV field
+	d.applyEvent(&PageEvent{EventType: "copyAndPaste", FormID: "inputCVV", Action: "paste", Length: 2, Received: received})
+
+	if !d.Timing.FirstKeystroke.Equal(received.Add(-600 * time.Millisecond)) {
+		t.Errorf("Unexpected first keystroke time: %v", d.Timing.FirstKeystroke)
+	}
+	email := d.Typing["inputEmail"]
+	if email == nil || email.Keystrokes != 8 || email.Backspaces != 1 || email.Intervals != 4 || email.MeanInterval != 250 ||
+		email.Variance != 12500 || email.KeysPerSecond != 4 || email.BackspaceRatio != 0.125 || email.PastedRatio != 0 {
+		t.Errorf("Unexpected typing profile for inputEmail: %+v", email)
+	}
+	cvv := d.Typing["inputCVV"]
+	if cvv == nil || cvv.Keystrokes != 2 || cvv.MeanInterval != 50 || cvv.Variance != 0 || cvv.KeysPerSecond != 20 || cvv.PastedRatio != 0.5 {
+		t.Errorf("Unexpected typing profile for inputCVV: %+v", cvv)
+	}
+
+	for _, event := range []PageEvent{
+		{EventType: "keystrokes", FormID: "inputEmail", Keys: 2, Intervals: []int{-1}},
+		{EventType: "keystrokes", FormID: "inputEmail", Keys: 1, Backspaces: 2},
+		{EventType: "keystrokes", FormID: "inputEmail", Keys: 2, Intervals: make([]int, maxKeystrokeIntervals+1)},
+		{EventType: "keystrokes", FormID: "inputEmail", Keys: 2, Intervals: []int{maxKeystrokeInterval + 1}},
+		{EventType: "keystrokes", FormID: "inputEmail", Keys: 3, Intervals: []int{math.MaxInt32, math.MaxInt32}},
+	} {
+		if err := d.applyEvent(&event); err == nil {
+			t.Errorf("Expected error for invalid keystrokes event: %+v", event)
+		}
+	}
+}
+
+func TestDataKeystrokesBeforeCreated(t *testing.T) {
+	created := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	d := newData(testSessionID)
+	d.Timing.Created = created
+
+	// the client claims typing started 10 minutes before the page was served 5 seconds ago
+	event := PageEvent{EventType: "keystrokes", FormID: "inputEmail", Keys: 2, Intervals: []int{600000}, Received: created.Add(5 * time.Second)}
+	if err := d.applyEvent(&event); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Timing.FirstKeystroke.Equal(created) {
+		t.Errorf("Unexpected first keystroke time: %v", d.Timing.FirstKeystroke)
+	}
+	d.formPosted(created.Add(15 * time.Second))
+	if d.ServerCompletionTime != 15000 {
+		t.Errorf("Unexpected server completion time: %dms", d.ServerCompletionTime)
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A small expression language for risk rules, evaluated against a form's Data. For example:
+//
+//	CopyAndPaste.inputCardNumber && FormCompletionTime < 5
+//	CopyAndPaste["inputCVV"].Pastes > 0 || len(Resizes) >= 3
+//
+// Fields are named as in the Data struct, with map entries selected by key. Fields are checked
+// against the Data struct when the expression is compiled, so a misspelt field is an error rather
+// than a rule which never triggers. Missing map entries evaluate as zero values.
+//
+// Operators (lowest to highest precedence):
+//
+//	||
+//	&&
+//	==  !=  <  <=  >  >=
+//	+  -
+//	*  /
+//	!  - (unary)
+//
+// Numbers, strings (double quoted), true and false may be used as literals, and len() returns
+// the length of a string, slice or map. Any value may be used as a condition: zero numbers, empty
+// strings and missing, nil or empty structs, maps and slices are false.
+
+// exprType is the static type of an expression
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprNumber
+	exprString
+	exprObject // struct, map, slice or pointer - only usable as a condition or with len()
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprNumber:
+		return "number"
+	case exprString:
+		return "string"
+	default:
+		return "object"
+	}
+}
+
+// ExprError is an error in an expression, at a position in its source
+type ExprError struct {
+	Pos int // byte offset in the source
+	Msg string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+// Expr is a compiled expression
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+// CompileExpr parses an expression, checking the fields it uses exist in the Data struct
+func CompileExpr(src string) (*Expr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, dataType: reflect.TypeOf(Data{})}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval returns true if the expression is true for the data.
+// The caller must hold the data's mutex.
+func (e *Expr) Eval(d *Data) bool {
+	return truthy(e.root.eval(reflect.ValueOf(d).Elem()))
+}
+
+//
+// Lexer
+//
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// exprOperators lists our operators, with those sharing a first character longest first
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "+", "-", "*", "/", "(", ")", "[", "]", ".", ","}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// lexExpr splits an expression into tokens
+func lexExpr(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+next:
+	for i < len(src) {
+		c := src[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case isIdentStart(c):
+			for i < len(src) && (isIdentStart(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+		case isDigit(c):
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if _, err := strconv.ParseFloat(src[start:i], 64); err != nil {
+				return nil, &ExprError{start, fmt.Sprintf("invalid number %q", src[start:i])}
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], start})
+		case c == '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(src) {
+				return nil, &ExprError{start, "unterminated string"}
+			}
+			i++
+			s, err := strconv.Unquote(src[start:i])
+			if err != nil {
+				return nil, &ExprError{start, fmt.Sprintf("invalid string %s", src[start:i])}
+			}
+			tokens = append(tokens, token{tokString, s, start})
+		default:
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					i += len(op)
+					tokens = append(tokens, token{tokOp, op, start})
+					continue next
+				}
+			}
+			return nil, &ExprError{start, fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+//
+// Parser
+//
+
+type exprParser struct {
+	tokens   []token
+	pos      int
+	dataType reflect.Type
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it's one of the operators given
+func (p *exprParser) accept(ops ...string) (token, bool) {
+	tok := p.peek()
+	if tok.kind == tokOp {
+		for _, op := range ops {
+			if tok.text == op {
+				return p.next(), true
+			}
+		}
+	}
+	return tok, false
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok, ok := p.accept(op); !ok {
+		return p.errorf(tok, "expected %q but found %s", op, tok)
+	}
+	return nil
+}
+
+func (p *exprParser) errorf(tok token, format string, args ...interface{}) error {
+	return &ExprError{tok.pos, fmt.Sprintf(format, args...)}
+}
+
+// parseBinary parses a left associative sequence of operands separated by any of the operators given
+func (p *exprParser) parseBinary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.accept(ops...)
+		if !ok {
+			return x, nil
+		}
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if x, err = newBinaryNode(tok, x, y); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	x, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	// comparisons don't chain
+	if tok, ok := p.accept("==", "!=", "<", "<=", ">", ">="); ok {
+		y, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return newBinaryNode(tok, x, y)
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/")
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if tok, ok := p.accept("!", "-"); ok {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if tok.text == "-" && x.staticType() != exprNumber {
+			return nil, p.errorf(tok, "invalid operation: -%s", x.staticType())
+		}
+		return &unaryNode{op: tok.text, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		f, _ := strconv.ParseFloat(tok.text, 64) // checked by the lexer
+		return &literalNode{f}, nil
+	case tokString:
+		return &literalNode{tok.text}, nil
+	case tokIdent:
+		switch {
+		case tok.text == "true":
+			return &literalNode{true}, nil
+		case tok.text == "false":
+			return &literalNode{false}, nil
+		case p.peek().text == "(" && p.peek().kind == tokOp:
+			return p.parseCall(tok)
+		default:
+			return p.parsePath(tok)
+		}
+	case tokOp:
+		if tok.text == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, p.errorf(tok, "unexpected %s", tok)
+}
+
+// parseCall parses a call of one of our built in functions
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+	if name.text != "len" {
+		return nil, p.errorf(name, "unknown function %q", name.text)
+	}
+	p.next() // opening bracket
+	var args []exprNode
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) != 1 {
+		return nil, p.errorf(name, "len expects 1 argument, got %d", len(args))
+	}
+	if path, ok := args[0].(*pathNode); args[0].staticType() != exprString && (!ok || !hasLen(path.rtype)) {
+		return nil, p.errorf(name, "invalid argument for len: %s", args[0].staticType())
+	}
+	return &lenNode{args[0]}, nil
+}
+
+// hasLen returns true if len() may be used on values of a type
+func hasLen(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+		return true
+	}
+	return false
+}
+
+// parsePath parses a field of Data, and any fields or map entries selected from it
+func (p *exprParser) parsePath(first token) (exprNode, error) {
+	n := &pathNode{}
+	t, err := p.selectField(first, p.dataType, first.text)
+	if err != nil {
+		return nil, err
+	}
+	n.path = append(n.path, first.text)
+	for {
+		var key token
+		if _, ok := p.accept("."); ok {
+			if key = p.next(); key.kind != tokIdent {
+				return nil, p.errorf(key, "expected field name after \".\" but found %s", key)
+			}
+		} else if _, ok := p.accept("["); ok {
+			if key = p.next(); key.kind != tokString {
+				return nil, p.errorf(key, "expected string key after \"[\" but found %s", key)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		} else {
+			break
+		}
+		if t, err = p.selectField(key, t, key.text); err != nil {
+			return nil, err
+		}
+		n.path = append(n.path, key.text)
+	}
+	n.rtype = t
+	return n, nil
+}
+
+// selectField returns the type of a field or map entry selected from a value of type t
+func (p *exprParser) selectField(tok token, t reflect.Type, name string) (reflect.Type, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if f, ok := t.FieldByName(name); ok && len(f.PkgPath) == 0 {
+			return f.Type, nil
+		}
+		return nil, p.errorf(tok, "unknown field %q in %s", name, t.Name())
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String {
+			return t.Elem(), nil
+		}
+	}
+	return nil, p.errorf(tok, "cannot select %q from %s", name, t)
+}
+
+//
+// Evaluation
+//
+
+// exprNode is a node of a compiled expression.
+// Values are bool, float64, string or (for objects) reflect.Value.
+type exprNode interface {
+	staticType() exprType
+	eval(data reflect.Value) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) staticType() exprType {
+	switch n.value.(type) {
+	case bool:
+		return exprBool
+	case float64:
+		return exprNumber
+	default:
+		return exprString
+	}
+}
+
+func (n *literalNode) eval(reflect.Value) interface{} {
+	return n.value
+}
+
+type pathNode struct {
+	path  []string
+	rtype reflect.Type
+}
+
+func (n *pathNode) staticType() exprType {
+	switch n.rtype.Kind() {
+	case reflect.Bool:
+		return exprBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return exprNumber
+	case reflect.String:
+		return exprString
+	default:
+		return exprObject
+	}
+}
+
+func (n *pathNode) eval(v reflect.Value) interface{} {
+	for _, name := range n.path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v = reflect.Zero(v.Type().Elem())
+			} else {
+				v = v.Elem()
+			}
+		}
+		if v.Kind() == reflect.Struct {
+			v = v.FieldByName(name)
+		} else if e := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key())); e.IsValid() {
+			v = e
+		} else {
+			v = reflect.Zero(v.Type().Elem())
+		}
+	}
+	switch n.staticType() {
+	case exprBool:
+		return v.Bool()
+	case exprString:
+		return v.String()
+	case exprNumber:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(v.Uint())
+		default:
+			return v.Float()
+		}
+	}
+	return v
+}
+
+type lenNode struct {
+	x exprNode
+}
+
+func (n *lenNode) staticType() exprType {
+	return exprNumber
+}
+
+func (n *lenNode) eval(data reflect.Value) interface{} {
+	switch x := n.x.eval(data).(type) {
+	case string:
+		return float64(len(x))
+	case reflect.Value:
+		return float64(x.Len())
+	}
+	return float64(0)
+}
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+func (n *unaryNode) staticType() exprType {
+	if n.op == "-" {
+		return exprNumber
+	}
+	return exprBool
+}
+
+func (n *unaryNode) eval(data reflect.Value) interface{} {
+	x := n.x.eval(data)
+	if n.op == "-" {
+		return -x.(float64)
+	}
+	return !truthy(x)
+}
+
+type binaryNode struct {
+	op   string
+	x, y exprNode
+}
+
+// newBinaryNode checks the operand types are valid for an operator
+func newBinaryNode(tok token, x, y exprNode) (exprNode, error) {
+	xt, yt := x.staticType(), y.staticType()
+	valid := true
+	switch tok.text {
+	case "&&", "||":
+	case "==", "!=":
+		valid = xt == yt && xt != exprObject
+	case "<", "<=", ">", ">=":
+		valid = xt == yt && (xt == exprNumber || xt == exprString)
+	default:
+		valid = xt == exprNumber && yt == exprNumber
+	}
+	if !valid {
+		return nil, &ExprError{tok.pos, fmt.Sprintf("invalid operation: %s %s %s", xt, tok.text, yt)}
+	}
+	return &binaryNode{op: tok.text, x: x, y: y}, nil
+}
+
+func (n *binaryNode) staticType() exprType {
+	switch n.op {
+	case "+", "-", "*", "/":
+		return exprNumber
+	}
+	return exprBool
+}
+
+func (n *binaryNode) eval(data reflect.Value) interface{} {
+	switch n.op {
+	case "&&":
+		return truthy(n.x.eval(data)) && truthy(n.y.eval(data))
+	case "||":
+		return truthy(n.x.eval(data)) || truthy(n.y.eval(data))
+	}
+
+	x, y := n.x.eval(data), n.y.eval(data)
+	switch n.op {
+	case "==":
+		return x == y
+	case "!=":
+		return x != y
+	}
+	if xs, ok := x.(string); ok {
+		ys := y.(string)
+		switch n.op {
+		case "<":
+			return xs < ys
+		case "<=":
+			return xs <= ys
+		case ">":
+			return xs > ys
+		default:
+			return xs >= ys
+		}
+	}
+	xf, yf := x.(float64), y.(float64)
+	switch n.op {
+	case "<":
+		return xf < yf
+	case "<=":
+		return xf <= yf
+	case ">":
+		return xf > yf
+	case ">=":
+		return xf >= yf
+	case "+":
+		return xf + yf
+	case "-":
+		return xf - yf
+	case "*":
+		return xf * yf
+	default:
+		return xf / yf
+	}
+}
+
+// truthy returns the value of an expression used as a condition
+func truthy(x interface{}) bool {
+	switch x := x.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return len(x) > 0
+	case reflect.Value:
+		switch x.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			return !x.IsNil()
+		case reflect.Map, reflect.Slice, reflect.Array:
+			return x.Len() > 0
+		default:
+			return !x.IsZero()
+		}
+	}
+	return false
+}
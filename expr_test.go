@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExprEval(t *testing.T) {
+	d := newData(testSessionID)
+	d.WebsiteURL = "http://localhost:8080/index.html"
+	d.CopyAndPaste["inputCardNumber"] = &ClipboardRecord{Pastes: 2, PastedLength: 16}
+	d.Typing["inputEmail"] = &TypingProfile{Keystrokes: 12, KeysPerSecond: 9.5}
+	d.FormCompletionTime = 4
+	d.Resizes = make([]ResizeEvent, 3)
+	d.Timing.Created = time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+
+	tests := map[string]bool{
+		"CopyAndPaste.inputCardNumber && FormCompletionTime < 5": true,
+		"CopyAndPaste.inputCVV && FormCompletionTime < 5":        false, // missing entry
+		"CopyAndPaste.inputCVV.Pastes == 0":                      true,  // zero values for a missing entry
+		`CopyAndPaste["inputCardNumber"].PastedLength >= 16`:     true,
+		"CopyAndPaste.inputCardNumber.PastedLength / 2 == 8":     true,
+		"len(Resizes) >= 3 && len(CopyAndPaste) == 1":            true,
+		"Resizes": true,
+		"Typing.inputEmail.KeysPerSecond > 9 || false": true,
+		"!Typing.inputCVV":                                         true,
+		"-FormCompletionTime + 10 > 5 * (1 + 0.5)":                 false,
+		"FormCompletionTime - 1 * 2 == 2":                          true,
+		`WebsiteURL == "http://localhost:8080/index.html"`:         true,
+		`WebsiteURL != "" && Tenant < "a"`:                         true,
+		"Timing.Created && !Timing.Posted":                         true,
+		"CompletionTimeMismatch == true":                           false,
+		"Risk":                                                     false, // nil pointer
+		"Risk.Score > 0 || len(Risk.Reasons) > 0 || Risk.HighRisk": false, // through nil pointer
+		"1 < 2 && 2 < 3 && !(3 < 2)":                               true,
+	}
+	for src, expected := range tests {
+		e, err := CompileExpr(src)
+		if err != nil {
+			t.Errorf("Failed to compile %q: %v", src, err)
+			continue
+		}
+		if result := e.Eval(d); result != expected {
+			t.Errorf("Unexpected result for %q: expected %v, got %v", src, expected, result)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	tests := map[string]string{
+		"":                             "column 1: unexpected end of expression",
+		"FormCompletionTime <":         "column 21: unexpected end of expression",
+		"FormCompletionTime # 5":       `column 20: unexpected character '#'`,
+		"FormCompletionTime < 5.5.5":   `column 22: invalid number "5.5.5"`,
+		`WebsiteURL == "http`:          "column 15: unterminated string",
+		"FormCompletionTim < 5":        `column 1: unknown field "FormCompletionTim" in Data`,
+		"CopyAndPaste.inputCVV.Pasted": `column 23: unknown field "Pasted" in ClipboardRecord`,
+		"mutex":                        `column 1: unknown field "mutex" in Data`,
+		"FormCompletionTime.Seconds":   `column 20: cannot select "Seconds" from int`,
+		"CopyAndPaste.":                `column 14: expected field name after "." but found end of expression`,
+		"CopyAndPaste[inputCVV]":       `column 14: expected string key after "[" but found "inputCVV"`,
+		`CopyAndPaste["inputCVV"`:      `column 24: expected "]" but found end of expression`,
+		"(FormCompletionTime < 5":      `column 24: expected ")" but found end of expression`,
+		"FormCompletionTime < 5)":      `column 23: unexpected ")"`,
+		"FormCompletionTime 5":         `column 20: unexpected "5"`,
+		`FormCompletionTime < "5"`:     "column 20: invalid operation: number < string",
+		"CopyAndPaste == 1":            "column 14: invalid operation: object == number",
+		"Resizes + 1":                  "column 9: invalid operation: object + number",
+		"-WebsiteURL":                  "column 1: invalid operation: -string",
+		"count(Resizes)":               `column 1: unknown function "count"`,
+		"len(Resizes, CopyAndPaste)":   "column 1: len expects 1 argument, got 2",
+		"len(FormCompletionTime) > 1":  "column 1: invalid argument for len: number",
+		"1 < 2 < 3":                    `column 7: unexpected "<"`,
+	}
+	for src, expected := range tests {
+		if _, err := CompileExpr(src); err == nil || err.Error() != expected {
+			t.Errorf("Unexpected error for %q: expected %q, got %v", src, expected, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// journal record operations
+const (
+	opNew       = "new"       // a session was created
+	opEvent     = "event"     // an event was applied to a session
+	opThrottled = "throttled" // an event was rejected by a session's rate limit
+	opDelete    = "delete"    // a session was deleted or expired
+	opSnapshot  = "snapshot"  // the full state of a session (written on compaction)
+)
+
+// journalRecord is a single line in the session journal
+type journalRecord struct {
+	Op      string     `json:"op"`
+	ID      string     `json:"id"`
+	Time    time.Time  `json:"time"`
+	Seq     uint64     `json:"seq,omitempty"`     // number of events applied to (or throttled by) the session
+	Created time.Time  `json:"created,omitempty"` // session creation time (snapshot only)
+	Event   *PageEvent `json:"event,omitempty"`
+	Data    *Data      `json:"data,omitempty"`
+}
+
+// FileSessionManager is a SessionManager which keeps sessions in memory but journals every change
+// to an append-only file, so sessions survive a restart of the server.
+//
+// The journal is replayed on startup and periodically compacted by rewriting it with a single snapshot
+// record per live session. Each event record carries a per session sequence number so that events
+// journaled while a compaction is in progress are not applied twice on replay.
+type FileSessionManager struct {
+	*DataSessionManager
+
+	path     string
+	file     *os.File
+	enc      *json.Encoder
+	seqs     map[string]uint64 // count of events applied to each live session
+	records  int               // records written since the last compaction
+	pending  []*journalRecord  // records written while a compaction is in progress
+	compact  bool              // true while a compaction is in progress
+	jmutex   sync.Mutex        // guards all of the journal fields above
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// CreateFileSessionManager returns a new SessionManager journaling to the file at path, replaying any
+// existing journal first. Sessions expire as for CreateExpiringSessionManager, and the journal is compacted
+// every compactInterval (0 to only compact on Close).
+func CreateFileSessionManager(path string, idleTTL, maxLifetime, compactInterval time.Duration,
+	onExpire func(*Data)) (*FileSessionManager, error) {
+
+	m := &FileSessionManager{
+		path:    path,
+		seqs:    make(map[string]uint64),
+		stopped: make(chan struct{}),
+	}
+
+	// expired sessions must be journaled as deleted before being reported
+	m.DataSessionManager = CreateExpiringSessionManager(idleTTL, maxLifetime, func(d *Data) {
+		m.journal(&journalRecord{Op: opDelete, ID: d.SessionID, Time: timeNow()})
+		if onExpire != nil {
+			onExpire(d)
+		}
+	})
+
+	// replay then compact immediately so we start with a clean journal
+	if err := m.replay(); err != nil {
+		m.DataSessionManager.Close()
+		return nil, err
+	}
+	if err := m.Compact(); err != nil {
+		m.DataSessionManager.Close()
+		return nil, err
+	}
+	if compactInterval > 0 {
+		go m.compactor(compactInterval)
+	}
+	return m, nil
+}
+
+// NewSession creates a new session with a random session id and journals it
+func (m *FileSessionManager) NewSession() (*Data, error) {
+	id, err := makeSessionID()
+	if err != nil {
+		return nil, err
+	}
+	return m.NewSessionWithID(id)
+}
+
+// NewSessionWithID creates a new session with the given session id and journals it
+func (m *FileSessionManager) NewSessionWithID(id string) (*Data, error) {
+	d, err := m.DataSessionManager.NewSessionWithID(id)
+	if err != nil {
+		return nil, err
+	}
+	m.journal(&journalRecord{Op: opNew, ID: d.SessionID, Time: timeNow()})
+	return d, nil
+}
+
+// Delete removes the specified session id and journals the deletion
+func (m *FileSessionManager) Delete(sessionID string) {
+	m.DataSessionManager.Delete(sessionID)
+	m.journal(&journalRecord{Op: opDelete, ID: sessionID, Time: timeNow()})
+}
+
+// Update journals an event applied to a session's data
+func (m *FileSessionManager) Update(sessionID string, event *PageEvent) {
+	m.journal(&journalRecord{Op: opEvent, ID: sessionID, Time: timeNow(), Event: event})
+}
+
+// Throttled journals an event rejected by a session's rate limit
+func (m *FileSessionManager) Throttled(sessionID string) {
+	m.journal(&journalRecord{Op: opThrottled, ID: sessionID, Time: timeNow()})
+}
+
+// Persistent returns true as sessions are restored from the journal after a restart
+func (m *FileSessionManager) Persistent() bool {
+	return true
+}
+
+// Close stops the reaper and compactor, then compacts and closes the journal
+func (m *FileSessionManager) Close() {
+	m.stopOnce.Do(func() {
+		close(m.stopped)
+		m.DataSessionManager.Close()
+		if err := m.Compact(); err != nil {
+			log.Printf("ERROR: Failed to compact session journal: %v", err)
+		}
+		m.jmutex.Lock()
+		defer m.jmutex.Unlock()
+		m.file.Close()
+		m.file = nil
+	})
+}
+
+// replay loads all sessions from an existing journal (if any)
+func (m *FileSessionManager) replay() error {
+	file, err := os.Open(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		r := &journalRecord{}
+		if err := dec.Decode(r); err == io.EOF {
+			break
+		} else if err != nil {
+			// most likely a partially written final record - keep what we have
+			log.Printf("WARNING: Ignoring remainder of session journal %s: %v", m.path, err)
+			break
+		}
+
+		switch r.Op {
+		case opNew:
+			m.sessions[r.ID] = &Session{data: newData(r.ID), created: r.Time, lastActivity: r.Time}
+			m.sessions[r.ID].data.Timing.Created = r.Time
+			m.seqs[r.ID] = 0
+		case opSnapshot:
+			if r.Data == nil {
+				continue
+			}
+			r.Data.init()
+			m.sessions[r.ID] = &Session{data: r.Data, created: r.Created, lastActivity: r.Time}
+			m.seqs[r.ID] = r.Seq
+		case opEvent:
+			s, found := m.sessions[r.ID]
+			if !found || r.Event == nil || r.Seq <= m.seqs[r.ID] {
+				continue // deleted, or already included in a snapshot
+			}
+			r.Event.Received = r.Time
+			if err := s.data.applyEvent(r.Event); err != nil {
+				log.Printf("WARNING: Ignoring session journal event: %v", err)
+			}
+			s.lastActivity = r.Time
+			m.seqs[r.ID] = r.Seq
+		case opThrottled:
+			s, found := m.sessions[r.ID]
+			if !found || r.Seq <= m.seqs[r.ID] {
+				continue
+			}
+			s.data.ThrottledEvents++
+			m.seqs[r.ID] = r.Seq
+		case opDelete:
+			delete(m.sessions, r.ID)
+			delete(m.seqs, r.ID)
+		}
+	}
+	return nil
+}
+
+// journal appends a record to the journal file
+func (m *FileSessionManager) journal(r *journalRecord) {
+	m.jmutex.Lock()
+	defer m.jmutex.Unlock()
+
+	switch r.Op {
+	case opEvent, opThrottled:
+		m.seqs[r.ID]++
+		r.Seq = m.seqs[r.ID]
+	case opDelete:
+		delete(m.seqs, r.ID)
+	}
+	if m.compact {
+		m.pending = append(m.pending, r)
+	}
+	if m.file == nil {
+		return // closed
+	}
+	if err := m.enc.Encode(r); err != nil {
+		log.Printf("ERROR: Failed to write session journal: %v", err)
+	}
+	m.records++
+}
+
+// Compact rewrites the journal with a snapshot of each live session
+func (m *FileSessionManager) Compact() error {
+	m.jmutex.Lock()
+	m.compact = true
+	m.pending = nil
+	m.jmutex.Unlock()
+
+	// take a snapshot of each session in turn, locking the data before the journal as processEvent does
+	m.mutex.Lock()
+	sessions := make([]Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, *s)
+	}
+	m.mutex.Unlock()
+
+	snapshots := make([]*journalRecord, 0, len(sessions))
+	for _, s := range sessions {
+		s.data.mutex.Lock()
+		m.jmutex.Lock()
+		data, _ := json.Marshal(s.data) // take a deep copy as the data will continue to change
+		r := &journalRecord{
+			Op:      opSnapshot,
+			ID:      s.data.SessionID,
+			Time:    s.lastActivity,
+			Seq:     m.seqs[s.data.SessionID],
+			Created: s.created,
+			Data:    &Data{},
+		}
+		json.Unmarshal(data, r.Data)
+		m.jmutex.Unlock()
+		s.data.mutex.Unlock()
+		snapshots = append(snapshots, r)
+	}
+
+	m.jmutex.Lock()
+	defer m.jmutex.Unlock()
+	m.compact = false
+	if err := m.rewrite(append(snapshots, m.pending...)); err != nil {
+		return err
+	}
+	m.pending = nil
+	m.records = 0
+	return nil
+}
+
+// rewrite atomically replaces the journal with the supplied records and reopens it for appending
+func (m *FileSessionManager) rewrite(records []*journalRecord) error {
+	tmpPath := m.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return err
+	}
+
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file, err = os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	m.enc = json.NewEncoder(m.file)
+	return nil
+}
+
+// compactor periodically compacts the journal until the manager is closed
+func (m *FileSessionManager) compactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.jmutex.Lock()
+			changed := m.records > 0
+			m.jmutex.Unlock()
+			if changed {
+				if err := m.Compact(); err != nil {
+					log.Printf("ERROR: Failed to compact session journal: %v", err)
+				}
+			}
+		case <-m.stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSessionManagerReplay(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.log")
+
+	sm, err := CreateFileSessionManager(path, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("FileSessionManager: Failed to create: %v", err)
+	}
+	s1, _ := sm.NewSession()
+	s2, _ := sm.NewSession()
+	s3, _ := sm.NewSession()
+
+	apply := func(d *Data, event *PageEvent) {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		event.SessionID = d.SessionID
+		if err := d.applyEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		sm.Update(d.SessionID, event)
+	}
+	throttle := func(d *Data) {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.ThrottledEvents++
+		sm.Throttled(d.SessionID)
+	}
+	apply(s1, &PageEvent{EventType: "resize", WebsiteURL: "http://a.com", OldWidth: 1, OldHeight: 2, NewWidth: 3, NewHeight: 4})
+	apply(s2, &PageEvent{EventType: "copyAndPaste", WebsiteURL: "http://b.com", FormID: "inputCVV"})
+	throttle(s1)
+	if err := sm.Compact(); err != nil {
+		t.Fatalf("FileSessionManager: Failed to compact: %v", err)
+	}
+	apply(s2, &PageEvent{EventType: "timeTaken", WebsiteURL: "http://b.com", Time: 12})
+	throttle(s1)
+	throttle(s2)
+	sm.Delete(s3.SessionID)
+
+	// simulate a crash by reopening the journal without closing
+	sm.DataSessionManager.Close()
+	sm2, err := CreateFileSessionManager(path, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("FileSessionManager: Failed to reopen: %v", err)
+	}
+	defer sm2.Close()
+
+	d, found := sm2.Find(s1.SessionID)
+	if !found || d.WebsiteURL != "http://a.com" || d.ResizeTo != (Dimension{3, 4}) || d.ThrottledEvents != 2 {
+		t.Errorf("FileSessionManager: Session not restored (%v, %+v)", found, d)
+	}
+	d, found = sm2.Find(s2.SessionID)
+	if !found || d.CopyAndPaste["inputCVV"] == nil || d.FormCompletionTime != 12 || d.ThrottledEvents != 1 {
+		t.Errorf("FileSessionManager: Session not restored (%v, %+v)", found, d)
+	}
+	if _, found = sm2.Find(s3.SessionID); found {
+		t.Errorf("FileSessionManager: Deleted session restored (%s)", s3.SessionID)
+	}
+}
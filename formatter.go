@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter is an interface to write a Data update to an output stream in a particular format
+type Formatter interface {
+	Format(o io.Writer, d *Data, updateType string) error
+}
+
+// CreateFormatter returns the Formatter with the given name ("text", "json" or "logfmt"), outputting
+// websiteURLHashCode using the named hash (see urlHashes, default fnv32a if empty), ignoring any query if
+// stripQuery is set
+func CreateFormatter(name, hashName string, stripQuery bool) (Formatter, error) {
+	if err := validURLHash(hashName); err != nil {
+		return nil, err
+	}
+	switch name {
+	case "text":
+		return TextFormatter{Hash: hashName, StripQuery: stripQuery}, nil
+	case "json":
+		return JSONFormatter{Hash: hashName, StripQuery: stripQuery}, nil
+	case "logfmt":
+		return LogfmtFormatter{Hash: hashName, StripQuery: stripQuery}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", name)
+	}
+}
+
+// updateRecord is a single update as written by the structured formatters
+type updateRecord struct {
+	UpdateType string    `json:"updateType"`
+	Time       time.Time `json:"time"`
+	*Data
+	ResizeStats        ResizeStats `json:"resizeStats"`
+	WebsiteURLHashCode interface{} `json:"websiteURLHashCode"` // number for 32 bit hashes, otherwise a hex string
+}
+
+func newUpdateRecord(d *Data, updateType string, websiteURLHashCode interface{}) *updateRecord {
+	return &updateRecord{
+		UpdateType:         updateType,
+		Time:               timeNow().UTC(),
+		Data:               d,
+		ResizeStats:        d.ResizeStats(),
+		WebsiteURLHashCode: websiteURLHashCode,
+	}
+}
+
+// TextFormatter writes updates as a human readable multi-line block
+type TextFormatter struct {
+	Hash       string // hash used for websiteURLHashCode (default fnv32a)
+	StripQuery bool   // ignore the query when hashing the website URL
+}
+
+// Format writes the update to o
+func (f TextFormatter) Format(o io.Writer, d *Data, updateType string) error {
+	w := bufio.NewWriter(o)
+	fmt.Fprintf(w, "User Data Updated: %s\n", updateType)
+	fmt.Fprintf(w, "  WebsiteURL: %s\n", d.WebsiteURL)
+	fmt.Fprintf(w, "  SessionID: %s\n", d.SessionID)
+	fmt.Fprintf(w, "  ResizeFrom: (%d,%d)\n", d.ResizeFrom.Width, d.ResizeFrom.Height)
+	fmt.Fprintf(w, "  ResizeTo: (%d,%d)\n", d.ResizeTo.Width, d.ResizeTo.Height)
+	if stats := d.ResizeStats(); stats.Count > 0 {
+		fmt.Fprintf(w, "  Resizes: %d, min (%d,%d), max (%d,%d), orientation flips: %d\n", stats.Count,
+			stats.MinViewport.Width, stats.MinViewport.Height, stats.MaxViewport.Width, stats.MaxViewport.Height,
+			stats.OrientationFlips)
+	} else {
+		fmt.Fprintf(w, "  Resizes: 0\n")
+	}
+	fmt.Fprintf(w, "  copyAndPaste controls:")
+	fields := make([]string, 0, len(d.CopyAndPaste))
+	for next := range d.CopyAndPaste {
+		fields = append(fields, next)
+	}
+	sort.Strings(fields)
+	for _, next := range fields {
+		r := d.CopyAndPaste[next]
+		fmt.Fprintf(w, " %s (copy %d, cut %d, paste %d, pasted %d chars)", next, r.Copies, r.Cuts, r.Pastes, r.PastedLength)
+	}
+	fmt.Fprintf(w, "\n")
+	if len(d.Typing) > 0 {
+		fmt.Fprintf(w, "  typing profiles:")
+		fields = fields[:0]
+		for next := range d.Typing {
+			fields = append(fields, next)
+		}
+		sort.Strings(fields)
+		for _, next := range fields {
+			p := d.Typing[next]
+			fmt.Fprintf(w, " %s (keys %d, %.1f keys/s, interval %.0fms sd %.0fms, backspaces %.0f%%, pasted %.0f%%)", next,
+				p.Keystrokes, p.KeysPerSecond, p.MeanInterval, math.Sqrt(p.Variance), p.BackspaceRatio*100, p.PastedRatio*100)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "  FormCompletionTime: %d seconds\n", d.FormCompletionTime)
+	if d.ThrottledEvents > 0 {
+		fmt.Fprintf(w, "  ThrottledEvents: %d\n", d.ThrottledEvents)
+	}
+	if !d.Timing.Posted.IsZero() {
+		mismatch := ""
+		if d.CompletionTimeMismatch {
+			mismatch = " (MISMATCH with client)"
+		}
+		fmt.Fprintf(w, "  ServerCompletionTime: %.3f seconds%s\n", float64(d.ServerCompletionTime)/1000, mismatch)
+	}
+	if d.Risk != nil {
+		level := "low"
+		if d.Risk.HighRisk {
+			level = "HIGH"
+		}
+		fmt.Fprintf(w, "  Risk: %d (%s)", d.Risk.Score, level)
+		if len(d.Risk.Reasons) > 0 {
+			fmt.Fprintf(w, " - %s", strings.Join(d.Risk.Reasons, "; "))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "  websiteURLHashCode: %v\n", websiteHashCode(f.Hash, f.StripQuery, d.WebsiteURL))
+	return w.Flush()
+}
+
+// JSONFormatter writes each update as a single line JSON object
+type JSONFormatter struct {
+	Hash       string // hash used for websiteURLHashCode (default fnv32a)
+	StripQuery bool   // ignore the query when hashing the website URL
+}
+
+// Format writes the update to o
+func (f JSONFormatter) Format(o io.Writer, d *Data, updateType string) error {
+	return json.NewEncoder(o).Encode(newUpdateRecord(d, updateType, websiteHashCode(f.Hash, f.StripQuery, d.WebsiteURL)))
+}
+
+// LogfmtFormatter writes each update as a single line of key=value pairs.
+// Nested fields are flattened using dotted keys (e.g. resizeTo.width=550).
+type LogfmtFormatter struct {
+	Hash       string // hash used for websiteURLHashCode (default fnv32a)
+	StripQuery bool   // ignore the query when hashing the website URL
+}
+
+// Format writes the update to o
+func (f LogfmtFormatter) Format(o io.Writer, d *Data, updateType string) error {
+	// use the JSON encoding so both structured formats have the same fields and names
+	b, err := json.Marshal(newUpdateRecord(d, updateType, websiteHashCode(f.Hash, f.StripQuery, d.WebsiteURL)))
+	if err != nil {
+		return err
+	}
+	var line strings.Builder
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = flattenJSON(dec, "", func(key string, value string) {
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(key)
+		line.WriteByte('=')
+		line.WriteString(logfmtValue(value))
+	})
+	if err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	_, err = io.WriteString(o, line.String())
+	return err
+}
+
+// flattenJSON reads the next JSON value from dec and calls emit for each scalar within it
+func flattenJSON(dec *json.Decoder, prefix string, emit func(key string, value string)) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	join := func(key string) string {
+		if len(prefix) == 0 {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if err := flattenJSON(dec, join(key.(string)), emit); err != nil {
+					return err
+				}
+			}
+		} else {
+			for i := 0; dec.More(); i++ {
+				if err := flattenJSON(dec, join(strconv.Itoa(i)), emit); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = dec.Token() // closing delimiter
+		return err
+	case nil:
+		emit(prefix, "")
+	default:
+		emit(prefix, fmt.Sprint(v))
+	}
+	return nil
+}
+
+// logfmtValue quotes a value if required
+func logfmtValue(v string) string {
+	if len(v) == 0 || strings.ContainsAny(v, " =\"\t\r\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formatterTestData returns Data with all fields set for testing formatters
+func formatterTestData() *Data {
+	d := newData(testSessionID)
+	d.WebsiteURL = "http://localhost:8080/index.html"
+	d.ResizeFrom = Dimension{500, 600}
+	d.ResizeTo = Dimension{550, 650}
+	d.CopyAndPaste["inputEmail"] = &ClipboardRecord{Pastes: 1, PastedLength: 11}
+	d.FormCompletionTime = 6
+	return d
+}
+
+func TestCreateFormatter(t *testing.T) {
+	for _, name := range []string{"text", "json", "logfmt"} {
+		if f, err := CreateFormatter(name, "", false); err != nil || f == nil {
+			t.Errorf("Failed to create formatter %s: %v", name, err)
+		}
+	}
+	if _, err := CreateFormatter("xml", "", false); err == nil {
+		t.Errorf("Created formatter for unknown format")
+	}
+	if _, err := CreateFormatter("text", "md5", false); err == nil {
+		t.Errorf("Created formatter for unknown hash")
+	}
+	if f, err := CreateFormatter("json", "fnv64a", true); err != nil || f.(JSONFormatter).Hash != "fnv64a" || !f.(JSONFormatter).StripQuery {
+		t.Errorf("Failed to create formatter with hash: %v", err)
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	now := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	var out bytes.Buffer
+	if err := (JSONFormatter{}).Format(&out, formatterTestData(), "resize"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(out.Bytes(), []byte("\n")) != 1 {
+		t.Errorf("Expected a single line of JSON, got: %s", out.String())
+	}
+
+	var record struct {
+		UpdateType         string
+		Time               time.Time
+		WebsiteURL         string `json:"websiteUrl"`
+		SessionID          string `json:"sessionId"`
+		ResizeTo           Dimension
+		CopyAndPaste       map[string]*ClipboardRecord
+		FormCompletionTime int
+		WebsiteURLHashCode uint32
+	}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Failed to decode JSON output: %v (%s)", err, out.String())
+	}
+	if record.UpdateType != "resize" || !record.Time.Equal(now) || record.WebsiteURL != "http://localhost:8080/index.html" ||
+		record.SessionID != testSessionID || record.ResizeTo != (Dimension{550, 650}) || record.CopyAndPaste["inputEmail"] == nil ||
+		record.FormCompletionTime != 6 || record.WebsiteURLHashCode != 2222077316 {
+		t.Errorf("Unexpected JSON output: %s", out.String())
+	}
+}
+
+func TestFormatterHash(t *testing.T) {
+	d := formatterTestData()
+	var out bytes.Buffer
+	if err := (JSONFormatter{Hash: "fnv64a"}).Format(&out, d, "resize"); err != nil {
+		t.Fatal(err)
+	}
+	// 64 bit hash codes are written as hex strings so they survive being decoded as floats
+	var record struct{ WebsiteURLHashCode string }
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil || record.WebsiteURLHashCode != fmt.Sprintf("%016x", HashString64(d.WebsiteURL)) {
+		t.Errorf("Unexpected 64 bit hash code in JSON output: %v (%s)", err, out.String())
+	}
+
+	out.Reset()
+	if err := (TextFormatter{Hash: "fnv128a"}).Format(&out, d, "resize"); err != nil {
+		t.Fatal(err)
+	}
+	h := CreateMyHash128()
+	h.Write([]byte(d.WebsiteURL))
+	if expected := fmt.Sprintf("  websiteURLHashCode: %x\n", h.Sum(nil)); !strings.HasSuffix(out.String(), expected) {
+		t.Errorf("Unexpected 128 bit hash code in text output, expected %q in:\n%s", expected, out.String())
+	}
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	timeNow = func() time.Time { return time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	var out bytes.Buffer
+	if err := (LogfmtFormatter{}).Format(&out, formatterTestData(), "(Form Posted)"); err != nil {
+		t.Fatal(err)
+	}
+	line := out.String()
+	if !strings.HasPrefix(line, `updateType="(Form Posted)" time=2017-03-04T10:11:12Z `) || strings.Count(line, "\n") != 1 {
+		t.Errorf("Unexpected logfmt output: %s", line)
+	}
+	for _, pair := range []string{
+		"websiteUrl=http://localhost:8080/index.html",
+		"sessionId=1234ABCD5678",
+		"resizeFrom.width=500 resizeFrom.height=600",
+		"resizeTo.width=550 resizeTo.height=650",
+		"copyAndPaste.inputEmail.pastes=1",
+		"copyAndPaste.inputEmail.pastedLength=11",
+		"formCompletionTime=6",
+		"resizeStats.count=0",
+		"websiteURLHashCode=2222077316\n",
+	} {
+		if !strings.Contains(line, " "+pair) {
+			t.Errorf("Failed to find %q in logfmt output: %s", pair, line)
+		}
+	}
+}
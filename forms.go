@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// field sensitivity classes
+const (
+	sensitivityPublic   = "public"   // no special handling required
+	sensitivityPersonal = "personal" // personally identifiable information (e.g. email)
+	sensitivityPayment  = "payment"  // payment card data (e.g. card number, CVV)
+)
+
+// defaultFormSchema is used when no schema is configured
+var defaultFormSchema = DefaultFormSchema()
+
+// FieldDefinition describes a single field in a form
+type FieldDefinition struct {
+	ID          string `json:"id"`
+	Sensitivity string `json:"sensitivity,omitempty"` // one of public, personal or payment (default public)
+}
+
+// FormDefinition describes a form and the fields we accept events for
+type FormDefinition struct {
+	ID     string            `json:"id"`
+	Fields []FieldDefinition `json:"fields"`
+
+	fields map[string]*FieldDefinition
+}
+
+// Field returns the definition of the field with the given id, or nil if the form has no such field
+func (f *FormDefinition) Field(id string) *FieldDefinition {
+	return f.fields[id]
+}
+
+// FormSchema is the set of all forms we serve, as loaded from a configuration file
+type FormSchema struct {
+	DefaultForm string            `json:"defaultForm"` // form issued with new sessions
+	Forms       []*FormDefinition `json:"forms"`
+
+	forms map[string]*FormDefinition
+}
+
+// Form returns the definition of the form with the given id, or nil if not found.
+// An empty id returns the default form.
+func (s *FormSchema) Form(id string) *FormDefinition {
+	if len(id) == 0 {
+		id = s.DefaultForm
+	}
+	return s.forms[id]
+}
+
+// init validates the schema and builds the lookup maps
+func (s *FormSchema) init() error {
+	s.forms = make(map[string]*FormDefinition)
+	for _, form := range s.Forms {
+		if len(form.ID) == 0 {
+			return fmt.Errorf("form with no id")
+		}
+		if _, found := s.forms[form.ID]; found {
+			return fmt.Errorf("duplicate form id: %s", form.ID)
+		}
+		form.fields = make(map[string]*FieldDefinition)
+		for i := range form.Fields {
+			field := &form.Fields[i]
+			if len(field.ID) == 0 {
+				return fmt.Errorf("field with no id in form %s", form.ID)
+			}
+			if _, found := form.fields[field.ID]; found {
+				return fmt.Errorf("duplicate field id in form %s: %s", form.ID, field.ID)
+			}
+			switch field.Sensitivity {
+			case "":
+				field.Sensitivity = sensitivityPublic
+			case sensitivityPublic, sensitivityPersonal, sensitivityPayment:
+			default:
+				return fmt.Errorf("invalid sensitivity for field %s in form %s: %s", field.ID, form.ID, field.Sensitivity)
+			}
+			form.fields[field.ID] = field
+		}
+		s.forms[form.ID] = form
+	}
+	if len(s.DefaultForm) == 0 && len(s.Forms) == 1 {
+		s.DefaultForm = s.Forms[0].ID
+	}
+	if _, found := s.forms[s.DefaultForm]; !found {
+		return fmt.Errorf("default form not found: %s", s.DefaultForm)
+	}
+	return nil
+}
+
+// LoadFormSchema loads and validates a schema from a JSON file
+func LoadFormSchema(path string) (*FormSchema, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	schema := &FormSchema{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(schema); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := schema.init(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// DefaultFormSchema returns the schema for the form in client/index.html
+func DefaultFormSchema() *FormSchema {
+	schema := &FormSchema{
+		DefaultForm: "inputForm",
+		Forms: []*FormDefinition{{
+			ID: "inputForm",
+			Fields: []FieldDefinition{
+				{ID: "inputEmail", Sensitivity: sensitivityPersonal},
+				{ID: "inputCardNumber", Sensitivity: sensitivityPayment},
+				{ID: "inputCVV", Sensitivity: sensitivityPayment},
+			},
+		}},
+	}
+	schema.init()
+	return schema
+}
+
+// FormRegistry holds the current FormSchema, which may be reloaded at any time
+type FormRegistry struct {
+	path   string // file to load from (empty to always use the default schema)
+	schema *FormSchema
+	mutex  sync.RWMutex
+}
+
+// CreateFormRegistry returns a registry with the schema loaded from path, or the default
+// schema if path is empty
+func CreateFormRegistry(path string) (*FormRegistry, error) {
+	r := &FormRegistry{path: path, schema: DefaultFormSchema()}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the schema from file again. On error the current schema is left in place.
+func (r *FormRegistry) Reload() error {
+	if len(r.path) == 0 {
+		return nil
+	}
+	schema, err := LoadFormSchema(r.path)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.schema = schema
+	return nil
+}
+
+// Schema returns the current schema
+func (r *FormRegistry) Schema() *FormSchema {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.schema
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadFormSchema(t *testing.T) {
+	schema, err := LoadFormSchema(filepath.Join("testdata", "forms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form := schema.Form(""); form == nil || form.ID != "checkout" {
+		t.Errorf("Unexpected default form: %+v", form)
+	}
+	if field := schema.Form("checkout").Field("inputCVV"); field == nil || field.Sensitivity != sensitivityPayment {
+		t.Errorf("Unexpected field definition: %+v", field)
+	}
+	if field := schema.Form("checkout").Field("inputPostcode"); field == nil || field.Sensitivity != sensitivityPublic {
+		t.Errorf("Unexpected field definition: %+v", field)
+	}
+	if field := schema.Form("signup").Field("inputCVV"); field != nil {
+		t.Errorf("Unexpected field in form: %+v", field)
+	}
+	if form := schema.Form("unknown"); form != nil {
+		t.Errorf("Unexpected form: %+v", form)
+	}
+}
+
+func TestLoadFormSchemaErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "forms.json")
+
+	tests := map[string]string{
+		`{"forms":[{"id":"a"},{"id":"a"}]}`:                                   "duplicate form id: a",
+		`{"forms":[{"id":"a","fields":[{"id":"x"},{"id":"x"}]}]}`:             "duplicate field id in form a: x",
+		`{"forms":[{"id":"a","fields":[{"id":"x","sensitivity":"secret"}]}]}`: "invalid sensitivity for field x in form a: secret",
+		`{"defaultForm":"b","forms":[{"id":"a"}]}`:                            "default form not found: b",
+		`{"forms":[{"id":"a","fields":[{"name":"x"}]}]}`:                      "unknown field",
+		`{"forms":[{"id":""}]}`:                                               "form with no id",
+	}
+	for config, expected := range tests {
+		ioutil.WriteFile(path, []byte(config), 0600)
+		if _, err := LoadFormSchema(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Unexpected error loading %s: expected %q, got %v", config, expected, err)
+		}
+	}
+}
+
+func TestFormRegistryReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "forms.json")
+
+	ioutil.WriteFile(path, []byte(`{"forms":[{"id":"a","fields":[{"id":"x"}]}]}`), 0600)
+	registry, err := CreateFormRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.Schema().Form("").Field("x") == nil {
+		t.Errorf("Failed to load form schema")
+	}
+
+	// a bad file leaves the current schema in place
+	ioutil.WriteFile(path, []byte(`{"forms":[`), 0600)
+	if err := registry.Reload(); err == nil || registry.Schema().Form("a") == nil {
+		t.Errorf("Expected reload to fail and keep current schema (%v)", err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"forms":[{"id":"b","fields":[{"id":"y"}]}]}`), 0600)
+	if err := registry.Reload(); err != nil || registry.Schema().Form("b").Field("y") == nil || registry.Schema().Form("a") != nil {
+		t.Errorf("Failed to reload form schema (%v)", err)
+	}
+}
+
+func TestServerAPICopyPasteFormSchema(t *testing.T) {
+	registry, err := CreateFormRegistry(filepath.Join("testdata", "forms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{sessionMgr: &MockSessionManager{t: t}, forms: registry}
+
+	data := dftTestData()
+	data.FormID = "signup"
+	if status, err := server.applyEvent(nil, &PageEvent{EventType: "copyAndPaste", FormID: "inputEmail"}, data); status != http.StatusOK {
+		t.Errorf("Unexpected status for field in form: %d (%v)", status, err)
+	}
+	if status, _ := server.applyEvent(nil, &PageEvent{EventType: "copyAndPaste", FormID: "inputCVV"}, data); status != http.StatusBadRequest {
+		t.Errorf("Unexpected status for field not in form: %d", status)
+	}
+	data.FormID = "unknown"
+	if status, _ := server.applyEvent(nil, &PageEvent{EventType: "copyAndPaste", FormID: "inputEmail"}, data); status != http.StatusBadRequest {
+		t.Errorf("Unexpected status for unknown form: %d", status)
+	}
+}
+
+func TestServerAPIKeystrokesFormSchema(t *testing.T) {
+	server := &Server{sessionMgr: &MockSessionManager{t: t}}
+	data := dftTestData()
+	if status, err := server.applyEvent(nil, &PageEvent{EventType: "keystrokes", FormID: "inputCVV", Keys: 1}, data); status != http.StatusOK {
+		t.Errorf("Unexpected status for field in form: %d (%v)", status, err)
+	}
+	if status, _ := server.applyEvent(nil, &PageEvent{EventType: "keystrokes", FormID: "inputUnknown", Keys: 1}, data); status != http.StatusBadRequest {
+		t.Errorf("Unexpected status for field not in form: %d", status)
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
-import "hash"
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/bits"
+)
 
 //
 // HashString calculates a 32 bit hash code for a supplied string and returns it
@@ -10,6 +16,7 @@ import "hash"
 // 	calculations which is then wrapped in a helper function to simplify the strings use case
 //	2. The hash code is non-cryptographic, instead being optimised for hash tables use
 //  3. This is implemented using a standard FNV-1a hash algorithm for 32 bit hash codes
+//  4. Strings with colliding hash codes are easily found, so use HashStringKeyed for server-side map keys
 //
 func HashString(str string) uint32 {
 	hasher := CreateMyHash32()
@@ -76,3 +83,192 @@ func (h *MyHash32) BlockSize() int {
 func (h *MyHash32) Sum32() uint32 {
 	return h.hashVal
 }
+
+// HashString64 calculates a 64 bit FNV-1a hash code for a supplied string and returns it.
+// With millions of URLs 32 bit hash codes collide frequently, 64 bit codes very rarely.
+func HashString64(str string) uint64 {
+	hasher := CreateMyHash64()
+	hasher.Write([]byte(str))
+	return hasher.Sum64()
+}
+
+const (
+	fv64Offset = 14695981039346656037
+	fv64Prime  = 1099511628211
+
+	// the 128 bit offset basis and prime, as high and low 64 bits (the prime is 2^88 + 0x13B)
+	fv128OffsetHigh = 0x6c62272e07bb0142
+	fv128OffsetLow  = 0x62b821756295c58d
+	fv128PrimeShift = 88 - 64
+	fv128PrimeLow   = 0x13b
+)
+
+// MyHash64 type implements the standard hash.Hash64 interface using FNV-1 or FNV-1a
+type MyHash64 struct {
+	hashVal uint64
+	fnv1a   bool // xor each byte before multiplying (FNV-1a) rather than after (FNV-1)
+}
+
+// CreateMyHash64 creates a new Hash64 implementation of the FNV-1a algorithm
+func CreateMyHash64() hash.Hash64 {
+	hv := MyHash64{fnv1a: true}
+	hv.Reset()
+	return &hv
+}
+
+// CreateMyHash64FNV1 creates a new Hash64 implementation of the FNV-1 algorithm
+func CreateMyHash64FNV1() hash.Hash64 {
+	hv := MyHash64{}
+	hv.Reset()
+	return &hv
+}
+
+// Write takes a sequence of bytes to hash and accumulates the hash code
+// Returns the number of bytes processed (all of them)
+func (h *MyHash64) Write(b []byte) (int, error) {
+	if h.fnv1a {
+		for _, next := range b {
+			h.hashVal ^= uint64(next)
+			h.hashVal *= fv64Prime
+		}
+	} else {
+		for _, next := range b {
+			h.hashVal *= fv64Prime
+			h.hashVal ^= uint64(next)
+		}
+	}
+	return len(b), nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *MyHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.hashVal)
+	return append(b, sum[:]...)
+}
+
+// Reset resets the Hash to its initial state.
+func (h *MyHash64) Reset() {
+	h.hashVal = fv64Offset
+}
+
+// Size returns the number of bytes Sum will return.
+func (h *MyHash64) Size() int {
+	return 8
+}
+
+// BlockSize returns the hash's underlying block size.
+func (h *MyHash64) BlockSize() int {
+	return 1
+}
+
+// Sum64 returns the hash code
+func (h *MyHash64) Sum64() uint64 {
+	return h.hashVal
+}
+
+// MyHash128 type implements the standard hash.Hash interface using 128 bit FNV-1 or FNV-1a
+type MyHash128 struct {
+	high, low uint64 // hash code as high and low 64 bits
+	fnv1a     bool   // xor each byte before multiplying (FNV-1a) rather than after (FNV-1)
+}
+
+// CreateMyHash128 creates a new 128 bit implementation of the FNV-1a algorithm
+func CreateMyHash128() hash.Hash {
+	hv := MyHash128{fnv1a: true}
+	hv.Reset()
+	return &hv
+}
+
+// CreateMyHash128FNV1 creates a new 128 bit implementation of the FNV-1 algorithm
+func CreateMyHash128FNV1() hash.Hash {
+	hv := MyHash128{}
+	hv.Reset()
+	return &hv
+}
+
+// multiply multiplies the hash code by the FNV prime, modulo 2^128
+func (h *MyHash128) multiply() {
+	carry, low := bits.Mul64(h.low, fv128PrimeLow)
+	h.high = h.high*fv128PrimeLow + carry + h.low<<fv128PrimeShift
+	h.low = low
+}
+
+// Write takes a sequence of bytes to hash and accumulates the hash code
+// Returns the number of bytes processed (all of them)
+func (h *MyHash128) Write(b []byte) (int, error) {
+	for _, next := range b {
+		if h.fnv1a {
+			h.low ^= uint64(next)
+			h.multiply()
+		} else {
+			h.multiply()
+			h.low ^= uint64(next)
+		}
+	}
+	return len(b), nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *MyHash128) Sum(b []byte) []byte {
+	var sum [16]byte
+	binary.BigEndian.PutUint64(sum[:8], h.high)
+	binary.BigEndian.PutUint64(sum[8:], h.low)
+	return append(b, sum[:]...)
+}
+
+// Reset resets the Hash to its initial state.
+func (h *MyHash128) Reset() {
+	h.high, h.low = fv128OffsetHigh, fv128OffsetLow
+}
+
+// Size returns the number of bytes Sum will return.
+func (h *MyHash128) Size() int {
+	return 16
+}
+
+// BlockSize returns the hash's underlying block size.
+func (h *MyHash128) BlockSize() int {
+	return 1
+}
+
+// urlHashes are the hashes which may be selected for websiteURLHashCode in our output
+var urlHashes = map[string]func() hash.Hash{
+	"fnv32a":      func() hash.Hash { return CreateMyHash32() },
+	"fnv64":       func() hash.Hash { return CreateMyHash64FNV1() },
+	"fnv64a":      func() hash.Hash { return CreateMyHash64() },
+	"fnv128":      CreateMyHash128FNV1,
+	"fnv128a":     CreateMyHash128,
+	"murmur3_32":  func() hash.Hash { return CreateMurmur3Hash32(0) },
+	"murmur3_128": func() hash.Hash { return CreateMurmur3Hash128(0) },
+	"xxhash64":    func() hash.Hash { return CreateXXHash64(0) },
+}
+
+// dftURLHash is the hash used for websiteURLHashCode if none is selected
+const dftURLHash = "fnv32a"
+
+// validURLHash returns an error unless name is one of our urlHashes (or empty for the default)
+func validURLHash(name string) error {
+	if _, ok := urlHashes[name]; !ok && len(name) > 0 {
+		return fmt.Errorf("unknown hash: %s", name)
+	}
+	return nil
+}
+
+// urlHashCode returns the hash code of a URL using the named hash (or the default if empty or unknown).
+// 32 bit codes are returned as numbers, longer codes as hex strings - 64 bit numbers can't be represented
+// exactly in JSON by JavaScript (or jq).
+func urlHashCode(name, url string) interface{} {
+	create := urlHashes[name]
+	if create == nil {
+		create = urlHashes[dftURLHash]
+	}
+	hasher := create()
+	hasher.Write([]byte(url))
+	if h, ok := hasher.(hash.Hash32); ok {
+		return h.Sum32()
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"log"
 	"math"
 	"os"
@@ -124,3 +126,164 @@ func TestURLHashing(t *testing.T) {
 	fmt.Fprintf(out, "Min/Max: (%d,%d)\n", minCount, maxCount)
 	fmt.Fprintf(out, "Number of collisions from %d URLs: %d\n", count, collisions)
 }
+
+// TestMyHash64And128 checks our 64 and 128 bit hashes against known values, and the standard library's
+// implementations of the same algorithms
+func TestMyHash64And128(t *testing.T) {
+	tests := []struct {
+		name      string
+		hasher    hash.Hash
+		reference hash.Hash
+		size      int
+		empty     string // hash of the empty string (the offset basis)
+		a         string // hash of "a"
+	}{
+		{"FNV-1 64", CreateMyHash64FNV1(), fnv.New64(), 8,
+			"cbf29ce484222325", "af63bd4c8601b7be"},
+		{"FNV-1a 64", CreateMyHash64(), fnv.New64a(), 8,
+			"cbf29ce484222325", "af63dc4c8601ec8c"},
+		{"FNV-1 128", CreateMyHash128FNV1(), fnv.New128(), 16,
+			"6c62272e07bb014262b821756295c58d", "d228cb69101a8caf78912b704e4a141e"},
+		{"FNV-1a 128", CreateMyHash128(), fnv.New128a(), 16,
+			"6c62272e07bb014262b821756295c58d", "d228cb696f1a8caf78912b704e4a8964"},
+	}
+	for _, test := range tests {
+		if test.hasher.Size() != test.size || test.hasher.BlockSize() != 1 {
+			t.Errorf("%s: incorrect size %d, block size %d", test.name, test.hasher.Size(), test.hasher.BlockSize())
+		}
+		if sum := fmt.Sprintf("%x", test.hasher.Sum(nil)); sum != test.empty {
+			t.Errorf("%s: incorrect hash code for empty string, expected %s, got %s", test.name, test.empty, sum)
+		}
+		test.hasher.Write([]byte("a"))
+		if sum := fmt.Sprintf("%x", test.hasher.Sum([]byte{})); sum != test.a {
+			t.Errorf("%s: incorrect hash code for \"a\", expected %s, got %s", test.name, test.a, sum)
+		}
+
+		for _, sample := range SamplesHashCodes {
+			test.hasher.Reset()
+			test.reference.Reset()
+			// write in two parts, to check the hash state carries across writes
+			half := len(sample.str) / 2
+			test.hasher.Write([]byte(sample.str[:half]))
+			test.hasher.Write([]byte(sample.str[half:]))
+			test.reference.Write([]byte(sample.str))
+			if sum, expected := test.hasher.Sum(nil), test.reference.Sum(nil); string(sum) != string(expected) {
+				t.Errorf("%s: incorrect hash code for string (%s), expected %x, got %x", test.name, sample.str, expected, sum)
+			}
+			if h, ok := test.hasher.(hash.Hash64); ok && h.Sum64() != test.reference.(hash.Hash64).Sum64() {
+				t.Errorf("%s: incorrect Sum64 for string (%s)", test.name, sample.str)
+			}
+		}
+	}
+}
+
+func TestHashString64(t *testing.T) {
+	for _, test := range SamplesHashCodes {
+		reference := fnv.New64a()
+		reference.Write([]byte(test.str))
+		if hc := HashString64(test.str); hc != reference.Sum64() {
+			t.Errorf("Incorrect hash code for string (%s), expected %v, got %v", test.str, reference.Sum64(), hc)
+		}
+	}
+}
+
+func TestURLHashCode(t *testing.T) {
+	const url = "http://bbc.co.uk/"
+	h128 := CreateMyHash128()
+	h128.Write([]byte(url))
+	m32, m128 := CreateMurmur3Hash32(0), CreateMurmur3Hash128(0)
+	m32.Write([]byte(url))
+	m128.Write([]byte(url))
+	xxh := CreateXXHash64(0)
+	xxh.Write([]byte(url))
+	tests := []struct {
+		name     string
+		expected interface{}
+	}{
+		{"", uint32(19800803)},
+		{"unknown", uint32(19800803)},
+		{"fnv32a", uint32(19800803)},
+		{"fnv64a", fmt.Sprintf("%016x", HashString64(url))},
+		{"xxhash64", fmt.Sprintf("%016x", xxh.Sum64())},
+		{"fnv128a", fmt.Sprintf("%x", h128.Sum(nil))},
+		{"murmur3_32", m32.Sum32()},
+		{"murmur3_128", fmt.Sprintf("%x", m128.Sum(nil))},
+	}
+	for _, test := range tests {
+		if hc := urlHashCode(test.name, url); hc != test.expected {
+			t.Errorf("Incorrect %q hash code, expected %v (%T), got %v (%T)", test.name, test.expected, test.expected, hc, hc)
+		}
+	}
+	if validURLHash("fnv128") != nil || validURLHash("") != nil || validURLHash("md5") == nil {
+		t.Errorf("Incorrect hash name validation")
+	}
+}
+
+// TestURLHashing64 checks there are no collisions between the 64 and 128 bit hash codes of our test URLs
+func TestURLHashing64(t *testing.T) {
+	urls := loadTestURLs(t)
+	for name, create := range urlHashes {
+		if create().Size() <= 4 {
+			continue // 32 bit hashes may well collide (see TestURLHashing)
+		}
+		hashCodes := make(map[interface{}]string)
+		for _, url := range urls {
+			hc := urlHashCode(name, string(url))
+			if other, found := hashCodes[hc]; found && other != string(url) {
+				t.Errorf("%s: duplicate hash value for strings (%s) and (%s): %v", name, url, other, hc)
+			}
+			hashCodes[hc] = string(url)
+		}
+	}
+}
+
+// loadTestURLs returns the URLs in testdata/urls.txt
+func loadTestURLs(tb testing.TB) [][]byte {
+	urlFile, err := os.Open(path.Join("testdata", "urls.txt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer urlFile.Close()
+	var urls [][]byte
+	scanner := bufio.NewScanner(urlFile)
+	for scanner.Scan() {
+		urls = append(urls, []byte(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return urls
+}
+
+// BenchmarkURLHashing compares the time taken by each of our hashes to hash all our test URLs
+func BenchmarkURLHashing(b *testing.B) {
+	urls := loadTestURLs(b)
+	var size int64
+	for _, url := range urls {
+		size += int64(len(url))
+	}
+	hashes := []struct {
+		name   string
+		hasher hash.Hash
+	}{
+		{"MyHash32", CreateMyHash32()},
+		{"MyHash64", CreateMyHash64()},
+		{"MyHash128", CreateMyHash128()},
+		{"Murmur3Hash32", CreateMurmur3Hash32(0)},
+		{"Murmur3Hash128", CreateMurmur3Hash128(0)},
+		{"XXHash64", CreateXXHash64(0)},
+	}
+	for _, h := range hashes {
+		b.Run(h.name, func(b *testing.B) {
+			b.SetBytes(size)
+			sum := make([]byte, 0, h.hasher.Size())
+			for i := 0; i < b.N; i++ {
+				for _, url := range urls {
+					h.hasher.Reset()
+					h.hasher.Write(url)
+					sum = h.hasher.Sum(sum[:0])
+				}
+			}
+		})
+	}
+}
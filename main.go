@@ -7,8 +7,64 @@
 //
 // Usage:
 //		Usage of go-codetest:
+//			-admin-key string
+//				key required (as a Bearer token) to use the /admin API (default none - admin API disabled)
+//			-allowed-origins string
+//				comma separated origins allowed to post events for any website, if no -tenants ("*" for any) (default each website's own origin)
+//			-cert string
+//				TLS certificate file (PEM) - implies -tls
+//			-compact duration
+//				how often to compact the session store (default 5m0s)
+//			-format string
+//				output format: text, json or logfmt (default "text")
+//			-forms string
+//				JSON file defining the forms and fields we accept events for (reloaded on SIGHUP)
+//			-hash string
+//				hash used for websiteURLHashCode in output (codes over 32 bits are hex strings): fnv32a, fnv64, fnv64a, fnv128, fnv128a, murmur3_32, murmur3_128 or xxhash64 (default "fnv32a")
+//			-idle duration
+//				expire sessions idle for longer than this (0 to disable) (default 30m0s)
+//			-key string
+//				TLS private key file (PEM)
+//			-maxlife duration
+//				expire sessions older than this (0 to disable) (default 2h0m0s)
 //			-p uint
-//				port to listen on (default 80)
+//				port to listen on (default 80, or 443 with -tls)
+//			-rate-ip float
+//				API requests allowed per second from each client IP (0 for no limit) (default 50)
+//			-rate-ip-burst int
+//				API requests allowed in a burst from each client IP (default 200)
+//			-rate-session float
+//				events allowed per second for each session (0 for no limit) (default 10)
+//			-rate-session-burst int
+//				events allowed in a burst for each session (default 50)
+//			-redirect-port uint
+//				port to redirect plain HTTP from to HTTPS (default none)
+//			-risk string
+//				JSON file defining the rules used to score posted forms (default the standard rules)
+//			-rotate-keep int
+//				number of rotated output files to keep (default 5)
+//			-rotate-size int
+//				size in bytes at which output files are rotated (0 to never rotate) (default 104857600)
+//			-session-key string
+//				secret used to sign session IDs - visible to other users, so prefer $CODETEST_SESSION_KEY or -session-key-file
+//			-session-key-file string
+//				file holding the secret used to sign session IDs, created with a random key if missing (default <store>.key with -store, otherwise a random key - issued session IDs are invalid after a restart)
+//			-shutdown-timeout duration
+//				time allowed for in-flight requests to complete on shutdown (default 15s)
+//			-sink value
+//				output destination: stdout, file:<path>, unix:<path> or http(s)://<url> (may be repeated) (default stdout)
+//			-sink-buffer int
+//				number of updates buffered for each output destination (default 1000)
+//			-store string
+//				file to persist sessions to (default none - sessions are held in memory only)
+//			-strip-query
+//				ignore query strings in website URLs when calculating websiteURLHashCode
+//			-tenants string
+//				JSON file defining the tenant websites we accept events for (default any website)
+//			-tls
+//				serve HTTPS and HTTP/2 (with an in-memory self-signed certificate if no -cert and -key)
+//			-trusted-proxies string
+//				comma separated IPs or CIDRs of proxies whose Forwarded or X-Forwarded-For headers give the client IP (default none)
 //
 // Build Instructions:
 //		1. No external dependencies are required
@@ -23,36 +79,246 @@
 //			Data 			- stores the user interaction data
 //			SessionManager	- maintain a session form (note that a new "session" is created for each load of the form)
 //			Server			- main web server
+//			FormRegistry	- the configured forms and the fields we accept events for
+//			TenantRegistry	- the tenant websites we accept events for, each with their own forms and outputs
+//			Formatter		- formats Data updates for output (text, JSON or logfmt)
+//			EventSink		- destinations for formatted updates (stdout, files, sockets, webhooks)
+//			RiskEngine		- scores posted forms against configurable rules
+//			TokenSigner		- issues session IDs signed with their issue time and website, so forged IDs are rejected
+//			Metrics			- counters and histograms exported in Prometheus format on /metrics
+//			admin API		- inspect, expire and delete live sessions on /admin/sessions
 //			client			- client side jQuery page
 //
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	dftPort = 80 // default listening port
+	dftPort             = 80               // default listening port
+	dftIdleTTL          = 30 * time.Minute // default time before an idle session expires
+	dftMaxLifetime      = 2 * time.Hour    // default maximum lifetime of any session
+	dftCompact          = 5 * time.Minute  // default interval between session store compactions
+	dftRotateSize       = 100 << 20        // default size at which output files are rotated
+	dftRotateKeep       = 5                // default number of rotated output files to keep
+	dftSinkBuffer       = 1000             // default number of updates buffered per sink
+	dftShutdownTimeout  = 15 * time.Second // default time allowed for in-flight requests on shutdown
+	dftRateSession      = 10               // default events per second allowed for each session
+	dftRateSessionBurst = 50               // default burst of events allowed for each session
+	dftRateIP           = 50               // default API requests per second allowed from each client IP
+	dftRateIPBurst      = 200              // default burst of API requests allowed from each client IP
 )
 
+// sessionKeyEnv is the environment variable holding the secret used to sign session IDs
+const sessionKeyEnv = "CODETEST_SESSION_KEY"
+
+// sinkList is a flag.Value collecting each output destination specified
+type sinkList []string
+
+func (l *sinkList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *sinkList) Set(spec string) error {
+	*l = append(*l, spec)
+	return nil
+}
+
 func main() {
 	//
 	// Configuration
 	//
-	port := flag.Uint("p", dftPort, "port to listen on")
+	port := flag.Uint("p", dftPort, "port to listen on (default 80, or 443 with -tls)")
+	useTLS := flag.Bool("tls", false, "serve HTTPS and HTTP/2 (with an in-memory self-signed certificate if no -cert and -key)")
+	certFile := flag.String("cert", "", "TLS certificate file (PEM) - implies -tls")
+	keyFile := flag.String("key", "", "TLS private key file (PEM)")
+	redirectPort := flag.Uint("redirect-port", 0, "port to redirect plain HTTP from to HTTPS (default none)")
+	idleTTL := flag.Duration("idle", dftIdleTTL, "expire sessions idle for longer than this (0 to disable)")
+	maxLifetime := flag.Duration("maxlife", dftMaxLifetime, "expire sessions older than this (0 to disable)")
+	storePath := flag.String("store", "", "file to persist sessions to (default none - sessions are held in memory only)")
+	format := flag.String("format", "text", "output format: text, json or logfmt")
+	stripQuery := flag.Bool("strip-query", false, "ignore query strings in website URLs when calculating websiteURLHashCode")
+	hashName := flag.String("hash", dftURLHash, "hash used for websiteURLHashCode in output (codes over 32 bits are hex strings): fnv32a, fnv64, fnv64a, fnv128, fnv128a, murmur3_32, murmur3_128 or xxhash64")
+	compact := flag.Duration("compact", dftCompact, "how often to compact the session store")
+	formsPath := flag.String("forms", "", "JSON file defining the forms and fields we accept events for (reloaded on SIGHUP)")
+	tenantsPath := flag.String("tenants", "", "JSON file defining the tenant websites we accept events for (default any website)")
+	allowedOrigins := flag.String("allowed-origins", "", `comma separated origins allowed to post events for any website, if no -tenants ("*" for any) (default each website's own origin)`)
+	adminKey := flag.String("admin-key", "", "key required (as a Bearer token) to use the /admin API (default none - admin API disabled)")
+	rateSession := flag.Float64("rate-session", dftRateSession, "events allowed per second for each session (0 for no limit)")
+	rateSessionBurst := flag.Int("rate-session-burst", dftRateSessionBurst, "events allowed in a burst for each session")
+	rateIP := flag.Float64("rate-ip", dftRateIP, "API requests allowed per second from each client IP (0 for no limit)")
+	rateIPBurst := flag.Int("rate-ip-burst", dftRateIPBurst, "API requests allowed in a burst from each client IP")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated IPs or CIDRs of proxies whose Forwarded or X-Forwarded-For headers give the client IP (default none)")
+	riskPath := flag.String("risk", "", "JSON file defining the rules used to score posted forms (default the standard rules)")
+	var sinkSpecs sinkList
+	flag.Var(&sinkSpecs, "sink", "output destination: stdout, file:<path>, unix:<path> or http(s)://<url> (may be repeated) (default stdout)")
+	rotateSize := flag.Int64("rotate-size", dftRotateSize, "size in bytes at which output files are rotated (0 to never rotate)")
+	rotateKeep := flag.Int("rotate-keep", dftRotateKeep, "number of rotated output files to keep")
+	sinkBuffer := flag.Int("sink-buffer", dftSinkBuffer, "number of updates buffered for each output destination")
+	sessionKey := flag.String("session-key", "", "secret used to sign session IDs - visible to other users, so prefer $"+sessionKeyEnv+" or -session-key-file")
+	sessionKeyFile := flag.String("session-key-file", "", "file holding the secret used to sign session IDs, created with a random key if missing (default <store>.key with -store, otherwise a random key - issued session IDs are invalid after a restart)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", dftShutdownTimeout, "time allowed for in-flight requests to complete on shutdown")
 	flag.Parse()
 	if flag.NArg() > 0 {
 		flag.Usage()
 		return
 	}
 
+	formatter, err := CreateFormatter(*format, *hashName, *stripQuery)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tlsConfig *tls.Config
+	if len(*certFile) > 0 || len(*keyFile) > 0 {
+		if tlsConfig, err = LoadTLSConfig(*certFile, *keyFile); err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+	} else if *useTLS {
+		log.Printf("WARNING: No TLS certificate given, using a self-signed certificate for %s",
+			strings.Join(selfSignedHosts, ", "))
+		if tlsConfig, err = SelfSignedTLSConfig(selfSignedHosts); err != nil {
+			log.Fatalf("Failed to generate TLS certificate: %v", err)
+		}
+	}
+	portSet := false
+	flag.Visit(func(f *flag.Flag) { portSet = portSet || f.Name == "p" })
+	if tlsConfig != nil && !portSet {
+		*port = dftTLSPort
+	}
+
+	if len(sinkSpecs) == 0 {
+		sinkSpecs = sinkList{"stdout"}
+	}
+	sinkConfig := SinkConfig{
+		ContentType: "text/plain",
+		RotateSize:  *rotateSize,
+		RotateKeep:  *rotateKeep,
+		BufferSize:  *sinkBuffer,
+	}
+	if *format == "json" {
+		sinkConfig.ContentType = "application/x-ndjson"
+	}
+	var sinks MultiSink
+	for _, spec := range sinkSpecs {
+		sink, err := CreateEventSink(spec, sinkConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, sink)
+	}
+	defer sinks.Close()
+
+	forms, err := CreateFormRegistry(*formsPath)
+	if err != nil {
+		log.Fatalf("Failed to load forms: %v", err)
+	}
+	var tenants *TenantRegistry
+	if len(*tenantsPath) > 0 {
+		if tenants, err = LoadTenantRegistry(*tenantsPath, sinkConfig); err != nil {
+			log.Fatalf("Failed to load tenants: %v", err)
+		}
+		defer tenants.Close()
+	}
+	risk := DefaultRiskEngine()
+	if len(*riskPath) > 0 {
+		if risk, err = LoadRiskEngine(*riskPath); err != nil {
+			log.Fatalf("Failed to load risk rules: %v", err)
+		}
+	}
+	key := []byte(*sessionKey)
+	if len(key) == 0 {
+		key = []byte(os.Getenv(sessionKeyEnv))
+	}
+	keyPath := *sessionKeyFile
+	if len(keyPath) == 0 && len(*storePath) > 0 {
+		keyPath = *storePath + ".key" // stored sessions must still be valid after a restart
+	}
+	if len(key) == 0 && len(keyPath) > 0 {
+		if key, err = loadSessionKey(keyPath); err != nil {
+			log.Fatalf("Failed to load session key: %v", err)
+		}
+	}
+	tokens, err := NewTokenSigner(key, *maxLifetime)
+	if err != nil {
+		log.Fatalf("Failed to create session key: %v", err)
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			log.Printf("INFO: Reloading forms")
+			if err := forms.Reload(); err != nil {
+				log.Printf("ERROR: Failed to reload forms (keeping current forms): %v", err)
+			}
+			if tenants != nil {
+				if err := tenants.Reload(); err != nil {
+					log.Printf("ERROR: Failed to reload tenants (keeping current tenants): %v", err)
+				}
+			}
+		}
+	}()
+
 	// configure server then start it listening
 	server := &Server{
-		Port:       *port,
-		sessionMgr: CreateSessionManager(),
-		outFile:    os.Stdout,
+		Port:           *port,
+		TLSConfig:      tlsConfig,
+		RedirectPort:   *redirectPort,
+		sink:           sinks,
+		formatter:      formatter,
+		forms:          forms,
+		tenants:        tenants,
+		risk:           risk,
+		metrics:        NewMetrics(),
+		adminKey:       *adminKey,
+		sessionLimiter: NewRateLimiter(*rateSession, *rateSessionBurst),
+		ipLimiter:      NewRateLimiter(*rateIP, *rateIPBurst),
+		tokens:         tokens,
+		urlHash:        *hashName,
+		stripQuery:     *stripQuery,
+	}
+	if len(*allowedOrigins) > 0 {
+		server.allowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
+	if server.trustedProxies, err = ParseTrustedProxies(*trustedProxies); err != nil {
+		log.Fatalf("Failed to parse -trusted-proxies: %v", err)
+	}
+	if len(*storePath) > 0 {
+		sessionMgr, err := CreateFileSessionManager(*storePath, *idleTTL, *maxLifetime, *compact, server.sessionExpired)
+		if err != nil {
+			log.Fatalf("Failed to open session store: %v", err)
+		}
+		defer sessionMgr.Close()
+		server.sessionMgr = sessionMgr
+	} else {
+		sessionMgr := CreateExpiringSessionManager(*idleTTL, *maxLifetime, server.sessionExpired)
+		defer sessionMgr.Close()
+		server.sessionMgr = sessionMgr
+	}
+
+	// shut down cleanly on SIGINT or SIGTERM so open sessions are output
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-stop
+		log.Printf("INFO: Received %v, shutting down", sig)
+		if err := server.Shutdown(*shutdownTimeout); err != nil {
+			log.Printf("ERROR: Failed to shut down cleanly: %v", err)
+		}
+		close(stopped)
+	}()
+	if err := server.Start(); err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	log.Fatal(server.Start())
+	<-stopped // the deferred closes then flush our outputs and session store
 }
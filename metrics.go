@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsPrefix is prepended to the name of all our metrics
+const metricsPrefix = "codetest_"
+
+var (
+	// sessionLifetimeBuckets are the upper bounds (seconds) of the session lifetime histogram buckets
+	sessionLifetimeBuckets = []float64{5, 10, 30, 60, 120, 300, 600, 1800, 3600, 7200}
+
+	// requestDurationBuckets are the upper bounds (seconds) of the request latency histogram buckets
+	requestDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+	// metricEventTypes are the event types we report by name (anything else is reported as "unknown")
+	metricEventTypes = map[string]bool{
+		"resize":         true,
+		"copyAndPaste":   true,
+		"timeTaken":      true,
+		"firstKeystroke": true,
+		"keystrokes":     true,
+	}
+)
+
+// metricSeries is the value of a metric for one set of label values
+type metricSeries struct {
+	labels  []string
+	value   float64  // counter value, or histogram sum
+	count   uint64   // histogram count
+	buckets []uint64 // histogram counts per bucket (not cumulative)
+}
+
+// metricVec is a counter or histogram, partitioned by a set of labels
+type metricVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds of histogram buckets (nil for a counter)
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries // keyed by the label values
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	v := newCounterVec(name, help, labels...)
+	v.buckets = buckets
+	return v
+}
+
+// with returns the series for a set of label values, creating it if required.
+// The caller must hold the mutex.
+func (v *metricVec) with(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s := v.series[key]
+	if s == nil {
+		s = &metricSeries{labels: values}
+		if v.buckets != nil {
+			s.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// add adds to a counter
+func (v *metricVec) add(delta float64, values ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.with(values).value += delta
+}
+
+// observe adds an observation to a histogram
+func (v *metricVec) observe(x float64, values ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	s := v.with(values)
+	s.value += x
+	s.count++
+	if i := sort.SearchFloat64s(v.buckets, x); i < len(s.buckets) {
+		s.buckets[i]++
+	}
+}
+
+// write writes the metric in Prometheus text format, with series sorted by their label values
+func (v *metricVec) write(w io.Writer) {
+	kind := "counter"
+	if v.buckets != nil {
+		kind = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, kind)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		labels := formatLabels(v.labels, s.labels)
+		if v.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labels, formatFloat(s.value))
+			continue
+		}
+		names := append(append([]string{}, v.labels...), "le")
+		values := append(append([]string{}, s.labels...), "")
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.buckets[i]
+			values[len(values)-1] = formatFloat(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, s.count)
+	}
+}
+
+// formatLabels returns a set of labels in Prometheus text format (empty if there are none)
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Metrics holds the metrics we export
+type Metrics struct {
+	events          *metricVec // counter by event_type and status
+	sessionLifetime *metricVec // histogram by outcome
+	requestDuration *metricVec // histogram by handler
+	rejected        *metricVec // counter of requests for sessions we don't have, by reason
+}
+
+// NewMetrics returns a new set of metrics, all zero
+func NewMetrics() *Metrics {
+	return &Metrics{
+		events: newCounterVec(metricsPrefix+"events_total",
+			"Events received, by event type and response status code.", "event_type", "status"),
+		sessionLifetime: newHistogramVec(metricsPrefix+"session_lifetime_seconds",
+			"Time from a session being created to the form being posted or the session expiring.",
+			sessionLifetimeBuckets, "outcome"),
+		requestDuration: newHistogramVec(metricsPrefix+"request_duration_seconds",
+			"Time taken to handle requests, by handler.", requestDurationBuckets, "handler"),
+		rejected: newCounterVec(metricsPrefix+"sessions_rejected_total",
+			"Requests rejected as their session ID was never issued (invalid, wrong_website), has expired (expired), "+
+				"or isn't held (unknown - if session tokens aren't in use).", "reason"),
+	}
+}
+
+// countEvent counts an event received (no effect on nil Metrics)
+func (m *Metrics) countEvent(eventType string, status int) {
+	if m == nil {
+		return
+	}
+	if !metricEventTypes[eventType] {
+		eventType = "unknown" // don't let clients create any number of series
+	}
+	m.events.add(1, eventType, strconv.Itoa(status))
+}
+
+// sessionEnded records the lifetime of a session posted or expired (no effect on nil Metrics).
+// The caller must hold the data's mutex.
+func (m *Metrics) sessionEnded(data *Data, outcome string) {
+	if m == nil || data.Timing.Created.IsZero() {
+		return
+	}
+	m.sessionLifetime.observe(timeNow().Sub(data.Timing.Created).Seconds(), outcome)
+}
+
+// sessionRejected counts a request rejected as its session ID isn't valid (no effect on nil Metrics)
+func (m *Metrics) sessionRejected(reason string) {
+	if m == nil {
+		return
+	}
+	m.rejected.add(1, reason)
+}
+
+// requestHandled records the time taken to handle a request started at start (no effect on nil Metrics)
+func (m *Metrics) requestHandled(handler string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.observe(time.Since(start).Seconds(), handler)
+}
+
+// metricsHandler returns our metrics in Prometheus text format
+func (s *Server) metricsHandler(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(response)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "# HELP %sactive_sessions Sessions currently held.\n# TYPE %sactive_sessions gauge\n",
+		metricsPrefix, metricsPrefix)
+	fmt.Fprintf(w, "%sactive_sessions %d\n", metricsPrefix, s.sessionMgr.Count())
+	if s.metrics != nil {
+		s.metrics.events.write(w)
+		s.metrics.sessionLifetime.write(w)
+		s.metrics.requestDuration.write(w)
+		s.metrics.rejected.write(w)
+	}
+	if s.tenants != nil {
+		tenantCounters := []*metricVec{
+			newCounterVec(metricsPrefix+"tenant_sessions_total", "Sessions created, by tenant.", "tenant"),
+			newCounterVec(metricsPrefix+"tenant_events_total", "Events accepted, by tenant.", "tenant"),
+			newCounterVec(metricsPrefix+"tenant_rejected_total", "Events rejected, by tenant.", "tenant"),
+			newCounterVec(metricsPrefix+"tenant_posted_total", "Forms posted, by tenant.", "tenant"),
+			newCounterVec(metricsPrefix+"tenant_expired_total", "Sessions expired, by tenant.", "tenant"),
+		}
+		for _, t := range s.tenants.Tenants() {
+			c := t.Counters()
+			for i, value := range []uint64{c.Sessions, c.Events, c.Rejected, c.Posted, c.Expired} {
+				tenantCounters[i].add(float64(value), t.Name)
+			}
+		}
+		for _, v := range tenantCounters {
+			v.write(w)
+		}
+	}
+}
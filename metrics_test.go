@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	counter := newCounterVec("test_total", "A counter.", "a", "b")
+	counter.add(1, "x", `q"\`)
+	counter.add(2, "x", `q"\`)
+	counter.add(1.5, "w", "y")
+
+	histogram := newHistogramVec("test_seconds", "A histogram.", []float64{1, 5}, "h")
+	for _, x := range []float64{0.5, 1, 3, 10} {
+		histogram.observe(x, "api")
+	}
+
+	var out bytes.Buffer
+	counter.write(&out)
+	histogram.write(&out)
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{a="w",b="y"} 1.5
+test_total{a="x",b="q\"\\"} 3
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{h="api",le="1"} 2
+test_seconds_bucket{h="api",le="5"} 3
+test_seconds_bucket{h="api",le="+Inf"} 4
+test_seconds_sum{h="api"} 14.5
+test_seconds_count{h="api"} 4
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected metrics output: expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	now := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	tenants, err := LoadTenantRegistry(filepath.Join("testdata", "tenants.json"), SinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenants.Close()
+
+	data := dftTestData()
+	data.WebsiteURL = "http://localhost:8080/index.html"
+	data.Timing.Created = now.Add(-45 * time.Second)
+	mockSM := &MockSessionManager{
+		t: t,
+		findFn: func(sessionID string) (*Data, bool) {
+			return data, sessionID == testSessionID
+		},
+		countFn: func() int { return 7 },
+	}
+	server := &Server{sessionMgr: mockSM, tenants: tenants, metrics: NewMetrics()}
+	server.Init()
+
+	for _, body := range []string{
+		`{"eventType":"timeTaken","websiteUrl":"http://localhost:8080/index.html","sessionId":"1234ABCD5678","time":72}`,
+		`{"eventType":"timeTaken","websiteUrl":"http://localhost:8080/index.html","sessionId":"1234ABCD5678","time":73}`,
+		`{"eventType":"timeTaken","websiteUrl":"http://localhost:8080/index.html","sessionId":"BAD"}`,
+		`{"eventType":"madeUp","websiteUrl":"http://localhost:8080/index.html","sessionId":"1234ABCD5678"}`,
+		`{"eventType":`,
+	} {
+		server.apiHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "http://localhost/api", strings.NewReader(body)))
+	}
+	post := httptest.NewRequest("POST", "http://localhost/index.html", strings.NewReader(sessionIDControl+"="+testSessionID))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.processMainPage(httptest.NewRecorder(), post)
+
+	response := httptest.NewRecorder()
+	server.metricsHandler(response, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+	if response.Code != http.StatusOK || !strings.HasPrefix(response.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected metrics response: %d %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	body := response.Body.String()
+	for _, line := range []string{
+		"codetest_active_sessions 7",
+		`codetest_events_total{event_type="timeTaken",status="200"} 2`,
+		`codetest_events_total{event_type="timeTaken",status="403"} 1`,
+		`codetest_events_total{event_type="unknown",status="400"} 2`,
+		`codetest_session_lifetime_seconds_bucket{outcome="posted",le="30"} 0`,
+		`codetest_session_lifetime_seconds_bucket{outcome="posted",le="60"} 1`,
+		`codetest_session_lifetime_seconds_sum{outcome="posted"} 45`,
+		`codetest_request_duration_seconds_count{handler="api"} 5`,
+		`codetest_request_duration_seconds_count{handler="mainPage"} 1`,
+		`codetest_tenant_events_total{tenant="local"} 2`,
+		`codetest_tenant_posted_total{tenant="local"} 1`,
+		`codetest_tenant_sessions_total{tenant="shop"} 0`,
+	} {
+		if !strings.Contains(body, "\n"+line+"\n") && !strings.HasPrefix(body, line+"\n") {
+			t.Errorf("Failed to find %q in metrics:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	requestIDHeader    = "X-Request-Id"
+	serverTimingHeader = "Server-Timing"
+	maxRequestIDLength = 64
+)
+
+// Middleware wraps a handler with some cross-cutting logic
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps a handler in each middleware given, with the first being the outermost
+func chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// DefaultMiddleware returns our standard middleware chain
+func DefaultMiddleware() []Middleware {
+	return []Middleware{requestIDMiddleware, accessLogMiddleware, recoveryMiddleware, timingMiddleware}
+}
+
+// responseRecorder records the status and size of a response, and lets middleware
+// add headers just before they're written
+type responseRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytes        int
+	beforeHeader func(http.Header) // called (if set) just before the header is written
+}
+
+func newResponseRecorder(response http.ResponseWriter) *responseRecorder {
+	if r, ok := response.(*responseRecorder); ok {
+		return r // share one recorder between all our middleware
+	}
+	return &responseRecorder{ResponseWriter: response}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status != 0 {
+		return // already written
+	}
+	r.status = status
+	if r.beforeHeader != nil {
+		r.beforeHeader(r.Header())
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush passes flushes through to the underlying writer (if supported)
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//
+// Request IDs
+//
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request a context belongs to, or "" if none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID returns true if a request ID supplied by a client (or proxy) is safe to use
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c == '-' || c == '_' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+			return false
+		}
+	}
+	return true
+}
+
+// makeRequestID generates a new random request ID
+func makeRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware gives each request an ID, using the X-Request-Id header if supplied.
+// The ID is returned in the X-Request-Id response header, and available to handlers from RequestID.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = makeRequestID()
+		}
+		response.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(response, request.WithContext(context.WithValue(request.Context(), requestIDKey{}, id)))
+	})
+}
+
+//
+// Access logging
+//
+
+// accessLogMiddleware logs every request once it has been handled
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := newResponseRecorder(response)
+		next.ServeHTTP(recorder, request)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK // nothing written
+		}
+		log.Printf("ACCESS: %s %s %s %s %d %d %v\n", RequestID(request.Context()), request.RemoteAddr,
+			request.Method, request.URL.RequestURI(), status, recorder.bytes, time.Since(start))
+	})
+}
+
+//
+// Panic recovery
+//
+
+// recoveryMiddleware turns a panic in a handler into a 500 response, rather than dropping the connection
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		recorder := newResponseRecorder(response)
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // deliberate abort
+				}
+				log.Printf("ERROR: Panic handling %s %s (request %s): %v\n%s", request.Method, request.URL.RequestURI(),
+					RequestID(request.Context()), err, debug.Stack())
+				if recorder.status == 0 {
+					recorder.WriteHeader(http.StatusInternalServerError)
+				}
+			}
+		}()
+		next.ServeHTTP(recorder, request)
+	})
+}
+
+//
+// Timing
+//
+
+// timingMiddleware reports the time taken to handle each request in the Server-Timing response header
+func timingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := newResponseRecorder(response)
+		previous := recorder.beforeHeader
+		recorder.beforeHeader = func(header http.Header) {
+			header.Set(serverTimingHeader, fmt.Sprintf("app;dur=%.3f", time.Since(start).Seconds()*1000))
+			if previous != nil {
+				previous(header)
+			}
+		}
+		next.ServeHTTP(recorder, request)
+	})
+}
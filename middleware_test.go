@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	named := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(response, request)
+			})
+		}
+	}
+	h := chain(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { order = append(order, "handler") }),
+		named("a"), named("b"), named("c"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	if strings.Join(order, ",") != "a,b,c,handler" {
+		t.Errorf("Unexpected middleware order: %v", order)
+	}
+}
+
+func TestDefaultMiddleware(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stdout)
+
+	var handlerID string
+	h := chain(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		handlerID = RequestID(request.Context())
+		switch request.URL.Path {
+		case "/panic":
+			panic("test panic")
+		case "/abort":
+			panic(http.ErrAbortHandler)
+		}
+		response.WriteHeader(http.StatusTeapot)
+		response.Write([]byte("hello"))
+	}), DefaultMiddleware()...)
+
+	// client supplied request ID
+	request := httptest.NewRequest("GET", "http://localhost/tea?a=b", nil)
+	request.Header.Set(requestIDHeader, "abc-123")
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+	if response.Code != http.StatusTeapot || response.Body.String() != "hello" ||
+		response.Header().Get(requestIDHeader) != "abc-123" || handlerID != "abc-123" {
+		t.Errorf("Unexpected response: %d %q %v (request ID %q)", response.Code, response.Body.String(), response.Header(), handlerID)
+	}
+	if !strings.HasPrefix(response.Header().Get(serverTimingHeader), "app;dur=") {
+		t.Errorf("No Server-Timing header: %v", response.Header())
+	}
+	if !strings.Contains(logged.String(), "ACCESS: abc-123 192.0.2.1:1234 GET /tea?a=b 418 5 ") {
+		t.Errorf("Unexpected access log: %s", logged.String())
+	}
+
+	// invalid request IDs are replaced
+	for _, id := range []string{"", "bad id", strings.Repeat("a", maxRequestIDLength+1)} {
+		request = httptest.NewRequest("GET", "http://localhost/", nil)
+		request.Header.Set(requestIDHeader, id)
+		response = httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		if generated := response.Header().Get(requestIDHeader); len(generated) != 16 || generated != handlerID {
+			t.Errorf("Unexpected request ID for %q: %q (handler saw %q)", id, generated, handlerID)
+		}
+	}
+
+	// panics are recovered and logged
+	logged.Reset()
+	response = httptest.NewRecorder()
+	h.ServeHTTP(response, httptest.NewRequest("GET", "http://localhost/panic", nil))
+	if response.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status after panic: %d", response.Code)
+	}
+	if !strings.Contains(logged.String(), "ERROR: Panic handling GET /panic") || !strings.Contains(logged.String(), " /panic 500 0 ") {
+		t.Errorf("Unexpected log after panic: %s", logged.String())
+	}
+
+	// but deliberate aborts are passed on to the http.Server
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("Unexpected panic from abort: %v", err)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/abort", nil))
+	t.Errorf("Abort not passed on")
+}
+
+func TestServerHandlerIndependent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	// two servers in one process each have their own routes and sessions
+	var handlers []http.Handler
+	for _, count := range []int{1, 2} {
+		n := count
+		s := &Server{sessionMgr: &MockSessionManager{t: t, countFn: func() int { return n }}}
+		s.Init()
+		handlers = append(handlers, s.Handler())
+	}
+	for i, h := range handlers {
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+		expected := "codetest_active_sessions " + strconv.Itoa(i+1) + "\n"
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), expected) ||
+			len(response.Header().Get(requestIDHeader)) == 0 {
+			t.Errorf("Unexpected response from server %d: %d %s", i, response.Code, response.Body.String())
+		}
+	}
+}
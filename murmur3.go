@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// MurmurHash3 (https://github.com/aappleby/smhasher) processes 4 bytes (x86_32) or 16 bytes (x64_128)
+// at a time, so is much faster than FNV for long strings. Partial blocks are buffered between writes.
+
+const (
+	murmur32C1 = 0xcc9e2d51
+	murmur32C2 = 0x1b873593
+
+	murmur128C1 = 0x87c37b91114253d5
+	murmur128C2 = 0x4cf5ad432745937f
+)
+
+// Murmur3Hash32 type implements the standard hash.Hash32 interface using MurmurHash3 x86_32
+type Murmur3Hash32 struct {
+	seed   uint32
+	h1     uint32
+	length int     // total bytes written
+	buf    [4]byte // partial block
+	n      int     // bytes in buf
+}
+
+// CreateMurmur3Hash32 creates a new Hash32 implementation of MurmurHash3 x86_32 with the given seed
+func CreateMurmur3Hash32(seed uint32) hash.Hash32 {
+	h := &Murmur3Hash32{seed: seed}
+	h.Reset()
+	return h
+}
+
+// blocks mixes each whole block of b into the hash code, returning any remaining bytes
+func (h *Murmur3Hash32) blocks(b []byte) []byte {
+	for ; len(b) >= 4; b = b[4:] {
+		k1 := binary.LittleEndian.Uint32(b)
+		k1 *= murmur32C1
+		k1 = bits.RotateLeft32(k1, 15)
+		k1 *= murmur32C2
+		h.h1 ^= k1
+		h.h1 = bits.RotateLeft32(h.h1, 13)
+		h.h1 = h.h1*5 + 0xe6546b64
+	}
+	return b
+}
+
+// Write takes a sequence of bytes to hash and accumulates the hash code
+// Returns the number of bytes processed (all of them)
+func (h *Murmur3Hash32) Write(b []byte) (int, error) {
+	length := len(b)
+	h.length += length
+	if h.n > 0 {
+		copied := copy(h.buf[h.n:], b)
+		h.n += copied
+		b = b[copied:]
+		if h.n < len(h.buf) {
+			return length, nil
+		}
+		h.blocks(h.buf[:])
+		h.n = 0
+	}
+	h.n = copy(h.buf[:], h.blocks(b))
+	return length, nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *Murmur3Hash32) Sum(b []byte) []byte {
+	sum := h.Sum32()
+	return append(b, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// Reset resets the Hash to its initial state.
+func (h *Murmur3Hash32) Reset() {
+	h.h1 = h.seed
+	h.length = 0
+	h.n = 0
+}
+
+// Size returns the number of bytes Sum will return.
+func (h *Murmur3Hash32) Size() int {
+	return 4
+}
+
+// BlockSize returns the hash's underlying block size.
+func (h *Murmur3Hash32) BlockSize() int {
+	return 4
+}
+
+// Sum32 returns the hash code
+func (h *Murmur3Hash32) Sum32() uint32 {
+	h1 := h.h1
+	var k1 uint32
+	switch h.n {
+	case 3:
+		k1 ^= uint32(h.buf[2]) << 16
+		fallthrough
+	case 2:
+		k1 ^= uint32(h.buf[1]) << 8
+		fallthrough
+	case 1:
+		k1 ^= uint32(h.buf[0])
+		k1 *= murmur32C1
+		k1 = bits.RotateLeft32(k1, 15)
+		k1 *= murmur32C2
+		h1 ^= k1
+	}
+	h1 ^= uint32(h.length)
+	return fmix32(h1)
+}
+
+// fmix32 is the MurmurHash3 32 bit finalisation mix, forcing all bits of a hash block to avalanche
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// Murmur3Hash128 type implements the standard hash.Hash64 interface using MurmurHash3 x64_128.
+// Sum returns all 128 bits, Sum64 only the first 64.
+type Murmur3Hash128 struct {
+	seed   uint32
+	h1, h2 uint64
+	length int      // total bytes written
+	buf    [16]byte // partial block
+	n      int      // bytes in buf
+}
+
+// CreateMurmur3Hash128 creates a new implementation of MurmurHash3 x64_128 with the given seed
+func CreateMurmur3Hash128(seed uint32) hash.Hash64 {
+	h := &Murmur3Hash128{seed: seed}
+	h.Reset()
+	return h
+}
+
+// blocks mixes each whole block of b into the hash code, returning any remaining bytes
+func (h *Murmur3Hash128) blocks(b []byte) []byte {
+	h1, h2 := h.h1, h.h2
+	for ; len(b) >= 16; b = b[16:] {
+		k1 := binary.LittleEndian.Uint64(b)
+		k2 := binary.LittleEndian.Uint64(b[8:])
+
+		k1 *= murmur128C1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmur128C2
+		h1 ^= k1
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= murmur128C2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmur128C1
+		h2 ^= k2
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+	h.h1, h.h2 = h1, h2
+	return b
+}
+
+// Write takes a sequence of bytes to hash and accumulates the hash code
+// Returns the number of bytes processed (all of them)
+func (h *Murmur3Hash128) Write(b []byte) (int, error) {
+	length := len(b)
+	h.length += length
+	if h.n > 0 {
+		copied := copy(h.buf[h.n:], b)
+		h.n += copied
+		b = b[copied:]
+		if h.n < len(h.buf) {
+			return length, nil
+		}
+		h.blocks(h.buf[:])
+		h.n = 0
+	}
+	h.n = copy(h.buf[:], h.blocks(b))
+	return length, nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *Murmur3Hash128) Sum(b []byte) []byte {
+	h1, h2 := h.Sum128()
+	var sum [16]byte
+	binary.BigEndian.PutUint64(sum[:8], h1)
+	binary.BigEndian.PutUint64(sum[8:], h2)
+	return append(b, sum[:]...)
+}
+
+// Reset resets the Hash to its initial state.
+func (h *Murmur3Hash128) Reset() {
+	h.h1, h.h2 = uint64(h.seed), uint64(h.seed)
+	h.length = 0
+	h.n = 0
+}
+
+// Size returns the number of bytes Sum will return.
+func (h *Murmur3Hash128) Size() int {
+	return 16
+}
+
+// BlockSize returns the hash's underlying block size.
+func (h *Murmur3Hash128) BlockSize() int {
+	return 16
+}
+
+// Sum64 returns the first 64 bits of the hash code
+func (h *Murmur3Hash128) Sum64() uint64 {
+	h1, _ := h.Sum128()
+	return h1
+}
+
+// Sum128 returns the hash code as its first and second 64 bits
+func (h *Murmur3Hash128) Sum128() (uint64, uint64) {
+	h1, h2 := h.h1, h.h2
+	var k1, k2 uint64
+	tail := h.buf[:h.n]
+	if len(tail) > 8 {
+		for i := len(tail) - 1; i >= 8; i-- {
+			k2 ^= uint64(tail[i]) << (uint(i-8) * 8)
+		}
+		k2 *= murmur128C2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmur128C1
+		h2 ^= k2
+	}
+	if len(tail) > 8 {
+		tail = tail[:8]
+	}
+	if len(tail) > 0 {
+		for i := len(tail) - 1; i >= 0; i-- {
+			k1 ^= uint64(tail[i]) << (uint(i) * 8)
+		}
+		k1 *= murmur128C1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmur128C2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(h.length)
+	h2 ^= uint64(h.length)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+// fmix64 is the MurmurHash3 64 bit finalisation mix, forcing all bits of a hash block to avalanche
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
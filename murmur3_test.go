@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+)
+
+// published MurmurHash3 x86_32 test vectors
+var murmur32Vectors = []struct {
+	seed     uint32
+	str      string
+	expected uint32
+}{
+	{0, "", 0},
+	{1, "", 0x514e28b7},
+	{0xffffffff, "", 0x81f16f39},
+	{0, "\xff\xff\xff\xff", 0x76293b50},
+	{0, "\x21\x43\x65\x87", 0xf55b516b},
+	{0x5082edee, "\x21\x43\x65\x87", 0x2362f9de},
+	{0, "\x21\x43\x65", 0x7e4a8634},
+	{0, "\x21\x43", 0xa0f7b07a},
+	{0, "\x21", 0x72661cf4},
+	{0, "\x00\x00\x00\x00", 0x2362f9de},
+	{0x9747b28c, "aaaa", 0x5a97808a},
+	{0x9747b28c, "Hello, world!", 0x24884cba},
+	{0x9747b28c, "The quick brown fox jumps over the lazy dog", 0x2fa826cd},
+	{0, "hello", 0x248bfa47},
+	{0, "hello, world", 0x149bbb7f},
+	{0, "19 Jan 2038 at 3:14:07 AM", 0xe31e8a70},
+	{0, "The quick brown fox jumps over the lazy dog.", 0xd5c48bfc},
+}
+
+// published MurmurHash3 x64_128 test vectors
+var murmur128Vectors = []struct {
+	seed   uint32
+	str    string
+	h1, h2 uint64
+}{
+	{0, "", 0, 0},
+	{0, "hello", 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+	{0, "hello, world", 0x342fac623a5ebc8e, 0x4cdcbc079642414d},
+	{0, "19 Jan 2038 at 3:14:07 AM", 0xb89e5988b737affc, 0x664fc2950231b2cb},
+	{0, "The quick brown fox jumps over the lazy dog.", 0xcd99481f9ee902c9, 0x695da1a38987b6e7},
+}
+
+// writeInParts writes str to a hash split at every possible point, calling check after each
+func writeInParts(str string, h interface {
+	Write([]byte) (int, error)
+	Reset()
+}, check func(split int)) {
+	for split := 0; split <= len(str); split++ {
+		h.Reset()
+		h.Write([]byte(str[:split]))
+		h.Write([]byte(str[split:]))
+		check(split)
+	}
+}
+
+func TestMurmur3Hash32(t *testing.T) {
+	for _, test := range murmur32Vectors {
+		h := CreateMurmur3Hash32(test.seed)
+		if h.Size() != 4 || h.BlockSize() != 4 {
+			t.Fatalf("Incorrect size %d, block size %d", h.Size(), h.BlockSize())
+		}
+		writeInParts(test.str, h, func(split int) {
+			if h.Sum32() != test.expected {
+				t.Errorf("Incorrect hash code for %q (seed %x, split at %d), expected %08x, got %08x",
+					test.str, test.seed, split, test.expected, h.Sum32())
+			}
+		})
+		if sum := h.Sum([]byte{1}); len(sum) != 5 || sum[0] != 1 || uint32(sum[1])<<24|uint32(sum[4]) != test.expected&0xff0000ff {
+			t.Errorf("Incorrect Sum for %q: %x", test.str, sum)
+		}
+	}
+}
+
+func TestMurmur3Hash128(t *testing.T) {
+	for _, test := range murmur128Vectors {
+		h := CreateMurmur3Hash128(test.seed).(*Murmur3Hash128)
+		if h.Size() != 16 || h.BlockSize() != 16 {
+			t.Fatalf("Incorrect size %d, block size %d", h.Size(), h.BlockSize())
+		}
+		writeInParts(test.str, h, func(split int) {
+			if h1, h2 := h.Sum128(); h1 != test.h1 || h2 != test.h2 || h.Sum64() != test.h1 {
+				t.Errorf("Incorrect hash code for %q (seed %x, split at %d), expected %016x%016x, got %016x%016x",
+					test.str, test.seed, split, test.h1, test.h2, h1, h2)
+			}
+		})
+	}
+	// the tail is mixed in without changing the hash state, so more can be written afterwards
+	h := CreateMurmur3Hash128(0)
+	h.Write([]byte("hello, "))
+	h.Sum(nil)
+	h.Write([]byte("world"))
+	if sum := h.Sum(nil); len(sum) != 16 || h.Sum64() != 0x342fac623a5ebc8e {
+		t.Errorf("Incorrect hash code after Sum: %x", sum)
+	}
+}
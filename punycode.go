@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Punycode (RFC 3492) encodes internationalised domain name labels as ASCII, e.g. bücher -> xn--bcher-kva
+
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	punyPrefix      = "xn--" // ACE prefix for encoded labels
+)
+
+// punyAdapt returns the new bias after encoding a code point
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyDigit returns the character for a base 36 digit
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycode returns the Punycode encoding of a string (without the ACE prefix)
+func punycode(label string) string {
+	var out strings.Builder
+	runes := make([]rune, 0, len(label))
+	for _, r := range label {
+		runes = append(runes, r)
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	b := out.Len()
+	h := b
+	if b > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h < len(runes) {
+		// the next code point to encode is the smallest not yet encoded
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+// punycodeHost returns a host name with each label containing non-ASCII characters Punycode encoded
+func punycodeHost(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		for j := 0; j < len(label); j++ {
+			if label[j] >= utf8.RuneSelf {
+				labels[i] = punyPrefix + punycode(label)
+				break
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
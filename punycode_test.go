@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPunycode(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"españa.com", "xn--espaa-rta.com"},
+		{"中国", "xn--fiqs8s"},
+		{"日本語.jp", "xn--wgv71a119e.jp"},
+		{"www.παράδειγμα.gr", "www.xn--hxajbheg2az3al.gr"},
+	}
+	for _, test := range tests {
+		if host := punycodeHost(test.host); host != test.expected {
+			t.Errorf("Incorrect Punycode for %s, expected %s, got %s", test.host, test.expected, host)
+		}
+	}
+}
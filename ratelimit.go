@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitSweepInterval = time.Minute // how often idle buckets are discarded
+
+// tokenBucket holds the tokens available to one key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // time tokens was last updated
+}
+
+// RateLimiter is a thread safe set of token buckets, one per key (e.g. session ID or client IP).
+// Each bucket holds up to burst tokens, refilled at rate tokens per second, and each request takes one token.
+// A nil RateLimiter allows everything.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate requests per second per key, with bursts of up to burst requests.
+// Returns nil (no limit) if rate is not positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: timeNow(),
+	}
+}
+
+// Allow takes a token for key if one is available. If not, returns false with the time until one will be.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := timeNow()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep discards buckets which would have refilled by now, as they're the same as new buckets.
+// The caller must hold the mutex.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// ParseTrustedProxies parses a comma separated list of proxy IP addresses and CIDR blocks
+func ParseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", entry)
+		}
+		proxies = append(proxies, block)
+	}
+	return proxies, nil
+}
+
+// trustedProxy returns true if an address is one of our trusted proxies
+func (s *Server) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, block := range s.trustedProxies {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client addresses listed by the proxies a request passed through, the closest last.
+// The standard Forwarded header is used if present, otherwise X-Forwarded-For.
+func forwardedFor(request *http.Request) []string {
+	var addrs []string
+	if forwarded := request.Header["Forwarded"]; len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addrs = append(addrs, stripPort(strings.Trim(kv[1], `"`)))
+				}
+			}
+		}
+		return addrs
+	}
+	for _, addr := range strings.Split(strings.Join(request.Header["X-Forwarded-For"], ","), ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			addrs = append(addrs, stripPort(addr))
+		}
+	}
+	return addrs
+}
+
+// stripPort removes any port (and IPv6 brackets) from an address
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// clientIP returns the IP address a request came from. If it was passed on by one of our trusted proxies,
+// that's the last address added to the forwarding headers by a proxy we don't trust - anything before it
+// could have been made up by the client.
+func (s *Server) clientIP(request *http.Request) string {
+	ip := stripPort(request.RemoteAddr)
+	if !s.trustedProxy(ip) {
+		return ip
+	}
+	addrs := forwardedFor(request)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip = addrs[i]
+		if !s.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// tooManyRequests writes a 429 response telling the client when to retry
+func tooManyRequests(response http.ResponseWriter, retryAfter time.Duration) {
+	response.Header().Set("Retry-After", strconv.Itoa(retrySeconds(retryAfter)))
+	response.WriteHeader(http.StatusTooManyRequests)
+}
+
+// retrySeconds returns a retry delay in whole seconds, rounded up (as required by Retry-After)
+func retrySeconds(retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// throttleSession takes a token from a session's rate limit, counting the event in the session's data
+// as throttled if none is available. Returns the time until the session may post again if throttled.
+func (s *Server) throttleSession(sessionID string, data *Data) (bool, time.Duration) {
+	if ok, retryAfter := s.sessionLimiter.Allow(sessionID); !ok {
+		data.mutex.Lock()
+		data.ThrottledEvents++
+		s.sessionMgr.Throttled(sessionID) // record the change while we still hold the lock
+		data.mutex.Unlock()
+		return true, retryAfter
+	}
+	return false, 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if NewRateLimiter(0, 10) != nil {
+		t.Errorf("Created limiter with no rate")
+	}
+	var unlimited *RateLimiter
+	if ok, _ := unlimited.Allow("a"); !ok {
+		t.Errorf("Nil limiter throttled a request")
+	}
+
+	l := NewRateLimiter(2, 3) // 2 per second, bursts of 3
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Request %d of burst throttled", i+1)
+		}
+	}
+	if ok, retryAfter := l.Allow("a"); ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("Unexpected result after burst: %v, retry after %v", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("Request for another key throttled")
+	}
+
+	now = now.Add(250 * time.Millisecond)
+	if ok, retryAfter := l.Allow("a"); ok || retryAfter != 250*time.Millisecond {
+		t.Errorf("Unexpected result after partial refill: %v, retry after %v", ok, retryAfter)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("Request throttled after refill")
+	}
+
+	// buckets are refilled up to the burst size only, and discarded once idle
+	now = now.Add(rateLimitSweepInterval + time.Second)
+	for i := 0; i < 3; i++ {
+		l.Allow("a")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Errorf("Bucket refilled past burst size")
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("Idle buckets not discarded: %d", len(l.buckets))
+	}
+}
+
+func TestServerRateLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	now := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	data := dftTestData()
+	server := &Server{
+		sessionMgr:     &MockSessionManager{t: t, findFn: func(string) (*Data, bool) { return data, true }},
+		sessionLimiter: NewRateLimiter(1, 2),
+		ipLimiter:      NewRateLimiter(1, 4),
+		risk:           DefaultRiskEngine(),
+	}
+	server.Init()
+	event := `{"eventType":"timeTaken","time":5,"sessionId":"` + testSessionID + `"}`
+	post := func(url, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		return response
+	}
+
+	// the session's burst of 2 is accepted, then events are throttled and counted
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		response := post("http://localhost/api", event)
+		if response.Code != expected {
+			t.Errorf("Unexpected status for event %d: expected %d, got %d", i+1, expected, response.Code)
+		}
+		if expected == http.StatusTooManyRequests && response.Header().Get("Retry-After") != "1" {
+			t.Errorf("Unexpected Retry-After: %q", response.Header().Get("Retry-After"))
+		}
+	}
+	if data.ThrottledEvents != 1 {
+		t.Errorf("Throttled event not counted: %d", data.ThrottledEvents)
+	}
+
+	// throttled batch events are reported individually
+	report := &BatchResponse{}
+	if err := json.NewDecoder(post("http://localhost/api/batch", "["+event+"]").Body).Decode(report); err != nil {
+		t.Fatalf("Failed to decode batch response: %v", err)
+	}
+	if len(report.Results) != 1 || report.Results[0].Status != http.StatusTooManyRequests ||
+		report.Results[0].Error != "rate limit exceeded, retry after 1 seconds" || data.ThrottledEvents != 2 {
+		t.Errorf("Unexpected batch report: %+v (throttled %d)", report, data.ThrottledEvents)
+	}
+
+	// the IP's burst of 4 is now exhausted, so requests are rejected before reaching any session
+	if response := post("http://localhost/api", event); response.Code != http.StatusTooManyRequests || data.ThrottledEvents != 2 {
+		t.Errorf("Unexpected response once IP throttled: %d (throttled %d)", response.Code, data.ThrottledEvents)
+	}
+	if response := post("http://localhost/api/batch", "["+event+"]"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected batch response once IP throttled: %d", response.Code)
+	}
+
+	// throttling counts towards the session's risk score
+	if risk := server.risk.Assess(data); risk.Score != 30 || len(risk.Reasons) != 1 || risk.Reasons[0] != "2 events throttled" {
+		t.Errorf("Unexpected risk for throttled session: %+v", risk)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{trustedProxies: proxies}
+	tests := []struct {
+		remoteAddr string
+		header     string
+		value      string
+		expected   string
+	}{
+		{"203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"203.0.113.7:1234", "X-Forwarded-For", "198.51.100.1", "203.0.113.7"}, // not from a trusted proxy
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:1234", "X-Forwarded-For", "1.2.3.4, 198.51.100.1, 192.168.1.1", "198.51.100.1"}, // 1.2.3.4 made up by the client
+		{"10.1.2.3:1234", "X-Forwarded-For", "192.168.1.1, 10.0.0.2", "192.168.1.1"},               // all trusted
+		{"[::1]:1234", "Forwarded", `for="[2001:db8::17]:4711";proto=https`, "2001:db8::17"},
+		{"10.1.2.3:1234", "Forwarded", "for=1.2.3.4, for=198.51.100.1;by=10.1.2.3", "198.51.100.1"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "http://localhost/api", nil)
+		request.RemoteAddr = test.remoteAddr
+		if len(test.header) > 0 {
+			request.Header.Set(test.header, test.value)
+		}
+		if ip := server.clientIP(request); ip != test.expected {
+			t.Errorf("Unexpected client IP for %+v: %s", test, ip)
+		}
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "proxy.example.com", "10.0.0"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("Expected error parsing trusted proxies %q", spec)
+		}
+	}
+}
+
+func TestServerRateLimitsBehindProxy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	proxies, _ := ParseTrustedProxies("10.0.0.1")
+	server := &Server{
+		sessionMgr:     &MockSessionManager{t: t, findFn: func(string) (*Data, bool) { return dftTestData(), true }},
+		ipLimiter:      NewRateLimiter(1, 1),
+		trustedProxies: proxies,
+	}
+	server.Init()
+	post := func(clientIP string) int {
+		request := httptest.NewRequest("POST", "http://localhost/api",
+			strings.NewReader(`{"eventType":"timeTaken","time":5,"sessionId":"`+testSessionID+`"}`))
+		request.RemoteAddr = "10.0.0.1:5678"
+		request.Header.Set("X-Forwarded-For", clientIP)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// each visitor behind the proxy has their own limit
+	for i, test := range []struct {
+		clientIP string
+		expected int
+	}{
+		{"198.51.100.1", http.StatusOK},
+		{"198.51.100.2", http.StatusOK},
+		{"198.51.100.1", http.StatusTooManyRequests},
+	} {
+		if status := post(test.clientIP); status != test.expected {
+			t.Errorf("Unexpected status for request %d from %s: expected %d, got %d", i+1, test.clientIP, test.expected, status)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// dftRiskThreshold is the default score at or above which a submission is considered high risk
+const dftRiskThreshold = 50
+
+// RiskRule is an interface to a single heuristic evaluated against a completed form's Data
+type RiskRule interface {
+	Name() string
+	Evaluate(d *Data) (triggered bool, score int, reason string)
+}
+
+// RiskAssessment is the result of evaluating all rules against a form's Data
+type RiskAssessment struct {
+	Score    int      `json:"score"`
+	HighRisk bool     `json:"highRisk"`
+	Reasons  []string `json:"reasons,omitempty"` // reason for each rule triggered
+}
+
+// RiskEngine evaluates a set of rules against completed forms
+type RiskEngine struct {
+	Rules     []RiskRule
+	Threshold int // score at or above which a submission is high risk
+}
+
+// Assess evaluates every rule against the data, summing the score of each rule triggered.
+// The caller must hold the data's mutex.
+func (e *RiskEngine) Assess(d *Data) *RiskAssessment {
+	a := &RiskAssessment{}
+	for _, rule := range e.Rules {
+		if triggered, score, reason := rule.Evaluate(d); triggered {
+			a.Score += score
+			a.Reasons = append(a.Reasons, reason)
+		}
+	}
+	a.HighRisk = a.Score >= e.Threshold
+	return a
+}
+
+// DefaultRiskEngine returns an engine with our standard rules
+func DefaultRiskEngine() *RiskEngine {
+	return &RiskEngine{
+		Threshold: dftRiskThreshold,
+		Rules: []RiskRule{
+			&PastedFieldRule{Field: "inputCVV", Score: 40},
+			&PastedFieldRule{Field: "inputCardNumber", Score: 20},
+			&FastCompletionRule{Seconds: 5, Score: 30},
+			&ResizeCountRule{Count: 3, Score: 20},
+			&CompletionMismatchRule{Score: 30},
+			&ThrottledRule{Score: 30},
+		},
+	}
+}
+
+//
+// Rules
+//
+
+// PastedFieldRule triggers if anything was pasted into a field
+type PastedFieldRule struct {
+	Field string
+	Score int
+}
+
+// Name returns the name of the rule
+func (r *PastedFieldRule) Name() string {
+	return "pasted:" + r.Field
+}
+
+// Evaluate evaluates the rule
+func (r *PastedFieldRule) Evaluate(d *Data) (bool, int, string) {
+	if record := d.CopyAndPaste[r.Field]; record != nil && record.Pastes > 0 {
+		return true, r.Score, fmt.Sprintf("%s pasted", r.Field)
+	}
+	return false, 0, ""
+}
+
+// FastCompletionRule triggers if the form was completed in less than a number of seconds.
+// We use our own completion time if known, otherwise the time reported by the client.
+type FastCompletionRule struct {
+	Seconds int
+	Score   int
+}
+
+// Name returns the name of the rule
+func (r *FastCompletionRule) Name() string {
+	return "fastCompletion"
+}
+
+// Evaluate evaluates the rule
+func (r *FastCompletionRule) Evaluate(d *Data) (bool, int, string) {
+	elapsed := time.Duration(d.ServerCompletionTime) * time.Millisecond
+	if elapsed == 0 {
+		elapsed = time.Duration(d.FormCompletionTime) * time.Second
+	}
+	if elapsed > 0 && elapsed < time.Duration(r.Seconds)*time.Second {
+		return true, r.Score, fmt.Sprintf("completed in %v (under %d seconds)", elapsed, r.Seconds)
+	}
+	return false, 0, ""
+}
+
+// ResizeCountRule triggers if the page was resized at least a number of times
+type ResizeCountRule struct {
+	Count int
+	Score int
+}
+
+// Name returns the name of the rule
+func (r *ResizeCountRule) Name() string {
+	return "resizes"
+}
+
+// Evaluate evaluates the rule
+func (r *ResizeCountRule) Evaluate(d *Data) (bool, int, string) {
+	if n := len(d.Resizes); n >= r.Count {
+		return true, r.Score, fmt.Sprintf("resized %d times", n)
+	}
+	return false, 0, ""
+}
+
+// CompletionMismatchRule triggers if the client reported completion time doesn't match our own
+type CompletionMismatchRule struct {
+	Score int
+}
+
+// Name returns the name of the rule
+func (r *CompletionMismatchRule) Name() string {
+	return "completionMismatch"
+}
+
+// Evaluate evaluates the rule
+func (r *CompletionMismatchRule) Evaluate(d *Data) (bool, int, string) {
+	if d.CompletionTimeMismatch {
+		return true, r.Score, fmt.Sprintf("client completion time %ds does not match server time %dms",
+			d.FormCompletionTime, d.ServerCompletionTime)
+	}
+	return false, 0, ""
+}
+
+// ThrottledRule triggers if any events were rejected by the session's rate limit
+type ThrottledRule struct {
+	Score int
+}
+
+// Name returns the name of the rule
+func (r *ThrottledRule) Name() string {
+	return "throttled"
+}
+
+// Evaluate evaluates the rule
+func (r *ThrottledRule) Evaluate(d *Data) (bool, int, string) {
+	if d.ThrottledEvents > 0 {
+		return true, r.Score, fmt.Sprintf("%d events throttled", d.ThrottledEvents)
+	}
+	return false, 0, ""
+}
+
+// ExprRule triggers if an expression over the form's Data is true
+type ExprRule struct {
+	RuleName string
+	When     *Expr
+	Score    int
+	Reason   string // (default the expression)
+}
+
+// Name returns the name of the rule
+func (r *ExprRule) Name() string {
+	if len(r.RuleName) == 0 {
+		return "expr"
+	}
+	return r.RuleName
+}
+
+// Evaluate evaluates the rule
+func (r *ExprRule) Evaluate(d *Data) (bool, int, string) {
+	if r.When.Eval(d) {
+		reason := r.Reason
+		if len(reason) == 0 {
+			reason = r.When.String()
+		}
+		return true, r.Score, reason
+	}
+	return false, 0, ""
+}
+
+//
+// Configuration
+//
+
+// RiskRuleConfig is the configuration of a single rule. The parameters used depend on the type:
+//
+//	pasted				- field
+//	fastCompletion		- seconds
+//	resizes				- count
+//	completionMismatch	- (none)
+//	throttled			- (none)
+//	expr				- when (an expression, see expr.go), with an optional name and reason
+type RiskRuleConfig struct {
+	Type    string `json:"type"`
+	Score   int    `json:"score"`
+	Field   string `json:"field,omitempty"`
+	Seconds int    `json:"seconds,omitempty"`
+	Count   int    `json:"count,omitempty"`
+	Name    string `json:"name,omitempty"`
+	When    string `json:"when,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// RiskConfig is the configuration of a RiskEngine
+type RiskConfig struct {
+	Threshold int              `json:"threshold"`
+	Rules     []RiskRuleConfig `json:"rules"`
+}
+
+// createRiskRule creates a rule from its configuration
+func createRiskRule(config RiskRuleConfig) (RiskRule, error) {
+	switch config.Type {
+	case "pasted":
+		if len(config.Field) == 0 {
+			return nil, fmt.Errorf("pasted rule requires a field")
+		}
+		return &PastedFieldRule{Field: config.Field, Score: config.Score}, nil
+	case "fastCompletion":
+		if config.Seconds <= 0 {
+			return nil, fmt.Errorf("fastCompletion rule requires seconds")
+		}
+		return &FastCompletionRule{Seconds: config.Seconds, Score: config.Score}, nil
+	case "resizes":
+		if config.Count <= 0 {
+			return nil, fmt.Errorf("resizes rule requires a count")
+		}
+		return &ResizeCountRule{Count: config.Count, Score: config.Score}, nil
+	case "completionMismatch":
+		return &CompletionMismatchRule{Score: config.Score}, nil
+	case "throttled":
+		return &ThrottledRule{Score: config.Score}, nil
+	case "expr":
+		if len(config.When) == 0 {
+			return nil, fmt.Errorf("expr rule requires an expression")
+		}
+		when, err := CompileExpr(config.When)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", config.When, err)
+		}
+		return &ExprRule{RuleName: config.Name, When: when, Score: config.Score, Reason: config.Reason}, nil
+	default:
+		return nil, fmt.Errorf("unknown rule type: %q", config.Type)
+	}
+}
+
+// CreateRiskEngine creates an engine from its configuration
+func CreateRiskEngine(config *RiskConfig) (*RiskEngine, error) {
+	e := &RiskEngine{Threshold: config.Threshold}
+	if e.Threshold <= 0 {
+		e.Threshold = dftRiskThreshold
+	}
+	for i, rc := range config.Rules {
+		rule, err := createRiskRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		e.Rules = append(e.Rules, rule)
+	}
+	return e, nil
+}
+
+// LoadRiskEngine creates an engine from a JSON configuration file
+func LoadRiskEngine(path string) (*RiskEngine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &RiskConfig{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	e, err := CreateRiskEngine(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return e, nil
+}
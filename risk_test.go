@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// riskTestData returns Data for a form completed suspiciously quickly with the CVV pasted
+func riskTestData() *Data {
+	d := newData(testSessionID)
+	d.CopyAndPaste["inputCVV"] = &ClipboardRecord{Pastes: 1, PastedLength: 3}
+	d.CopyAndPaste["inputEmail"] = &ClipboardRecord{Copies: 1}
+	d.FormCompletionTime = 3
+	return d
+}
+
+func TestRiskEngineAssess(t *testing.T) {
+	e := DefaultRiskEngine()
+
+	if a := e.Assess(newData(testSessionID)); a.Score != 0 || a.HighRisk || len(a.Reasons) != 0 {
+		t.Errorf("Unexpected assessment of empty data: %+v", a)
+	}
+
+	a := e.Assess(riskTestData())
+	expected := []string{"inputCVV pasted", "completed in 3s (under 5 seconds)"}
+	if a.Score != 70 || !a.HighRisk || !reflect.DeepEqual(a.Reasons, expected) {
+		t.Errorf("Unexpected assessment: %+v", a)
+	}
+
+	// our own completion time is used in preference to the client's
+	d := riskTestData()
+	d.ServerCompletionTime = 8000
+	d.CompletionTimeMismatch = true
+	d.Resizes = make([]ResizeEvent, 3)
+	a = e.Assess(d)
+	expected = []string{"inputCVV pasted", "resized 3 times", "client completion time 3s does not match server time 8000ms"}
+	if a.Score != 90 || !a.HighRisk || !reflect.DeepEqual(a.Reasons, expected) {
+		t.Errorf("Unexpected assessment: %+v", a)
+	}
+}
+
+func TestLoadRiskEngine(t *testing.T) {
+	e, err := LoadRiskEngine(filepath.Join("testdata", "risk.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Threshold != 60 || len(e.Rules) != 5 || e.Rules[4].Name() != "cardPastedQuickly" {
+		t.Fatalf("Unexpected engine loaded: %+v", e)
+	}
+
+	// 50 + 30 is over our threshold, but 50 + 10 is only equal to it
+	if a := e.Assess(riskTestData()); a.Score != 80 || !a.HighRisk {
+		t.Errorf("Unexpected assessment: %+v", a)
+	}
+	d := riskTestData()
+	d.FormCompletionTime = 30
+	d.Resizes = make([]ResizeEvent, 2)
+	if a := e.Assess(d); a.Score != 60 || !a.HighRisk {
+		t.Errorf("Unexpected assessment: %+v", a)
+	}
+	d.CopyAndPaste["inputCVV"].Pastes = 0
+	if a := e.Assess(d); a.Score != 10 || a.HighRisk {
+		t.Errorf("Unexpected assessment: %+v", a)
+	}
+
+	d = riskTestData()
+	d.CopyAndPaste["inputCardNumber"] = &ClipboardRecord{Pastes: 1, PastedLength: 16}
+	expected := []string{"inputCVV pasted", "completed in 3s (under 10 seconds)", "card number pasted quickly"}
+	if a := e.Assess(d); a.Score != 105 || !reflect.DeepEqual(a.Reasons, expected) {
+		t.Errorf("Unexpected assessment: %+v", a)
+	}
+}
+
+func TestCreateRiskEngineErrors(t *testing.T) {
+	tests := []struct {
+		rule     RiskRuleConfig
+		expected string
+	}{
+		{RiskRuleConfig{Type: "pasted"}, "rule 1: pasted rule requires a field"},
+		{RiskRuleConfig{Type: "fastCompletion"}, "rule 1: fastCompletion rule requires seconds"},
+		{RiskRuleConfig{Type: "resizes", Count: -1}, "rule 1: resizes rule requires a count"},
+		{RiskRuleConfig{Type: "expr"}, "rule 1: expr rule requires an expression"},
+		{RiskRuleConfig{Type: "expr", When: "Resizes > 3"}, `rule 1: "Resizes > 3": column 9: invalid operation: object > number`},
+		{RiskRuleConfig{Type: "typing"}, `rule 1: unknown rule type: "typing"`},
+	}
+	for _, test := range tests {
+		config := &RiskConfig{Rules: []RiskRuleConfig{test.rule}}
+		if _, err := CreateRiskEngine(config); err == nil || err.Error() != test.expected {
+			t.Errorf("Unexpected error for %+v: expected %q, got %v", test.rule, test.expected, err)
+		}
+	}
+	if _, err := LoadRiskEngine(filepath.Join("testdata", "forms.json")); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("Loaded risk rules from a forms file: %v", err)
+	}
+}
+
+func TestServerPostFormHighRisk(t *testing.T) {
+	timeNow = func() time.Time { return time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	data := url.Values{}
+	data.Set(sessionIDControl, testSessionID)
+	test := &serverTestCase{
+		method:         "POST",
+		URL:            "http://localhost/index.html",
+		requestBody:    data.Encode(),
+		expectedStatus: http.StatusCreated,
+		findCalls:      1,
+		deleteCalls:    1,
+		testData:       dftTestData(),
+		risk:           DefaultRiskEngine(),
+	}
+	testServerRequest(t, test)
+	if test.testData.Risk == nil || test.testData.Risk.HighRisk {
+		t.Errorf("Unexpected risk assessment: %+v", test.testData.Risk)
+	}
+
+	test.testData = riskTestData()
+	test.expectedStatus = http.StatusAccepted
+	testServerRequest(t, test)
+	if test.testData.Risk == nil || test.testData.Risk.Score != 70 {
+		t.Errorf("Unexpected risk assessment: %+v", test.testData.Risk)
+	}
+}
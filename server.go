@@ -1,33 +1,61 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errSessionNotFound = errors.New("invalid or expired session")
+	errSessionExpired  = errors.New("session expired")
 )
 
 const (
 	sessionIDControl = "sessionID"
 	mainPageURL      = "/index.html"
 	apiURL           = "/api"
+	apiBatchURL      = "/api/batch"
+	metricsURL       = "/metrics"
 )
 
-// formControls contains a set of all valid form control ids
-var validControls = map[string]bool{
-	"inputEmail":      true,
-	"inputCVV":        true,
-	"inputCardNumber": true,
-}
-
 // Server implements our web server logic
 type Server struct {
 	Port             uint
+	TLSConfig        *tls.Config  // serve HTTPS using this configuration (default to plain HTTP)
+	RedirectPort     uint         // port to redirect plain HTTP from to HTTPS (default to none)
+	Middleware       []Middleware // wraps all our handlers, outermost first (default to DefaultMiddleware)
 	sessionMgr       SessionManager
-	outFile          *os.File // file to send out put to (default to stdout)
+	sink             EventSink       // destination for updates (default to none)
+	formatter        Formatter       // format of updates sent to sink (default to text)
+	forms            *FormRegistry   // forms we accept events for (default to DefaultFormSchema)
+	tenants          *TenantRegistry // websites we accept events for (default to any, using the settings above)
+	risk             *RiskEngine     // scores posted forms (default to no scoring)
+	metrics          *Metrics        // metrics exported on /metrics (default to none)
+	adminKey         string          // key required to use the admin API (default to admin API disabled)
+	allowedOrigins   []string        // origins allowed to post events for any website, if no tenants (default to each website's own)
+	sessionLimiter   *RateLimiter    // limits events per session (default to no limit)
+	ipLimiter        *RateLimiter    // limits API requests per client IP (default to no limit)
+	trustedProxies   []*net.IPNet    // proxies whose forwarding headers give the client IP (default to none)
+	tokens           *TokenSigner    // issues signed session IDs (default to random session IDs)
+	urlHash          string          // hash used for websiteURLHashCode in the admin API, as for our output (default fnv32a)
+	stripQuery       bool            // ignore query strings in website URLs when hashing them for the admin API
 	mainPageTemplate *template.Template
+
+	mutex          sync.Mutex
+	httpServer     *http.Server // set once started
+	redirectServer *http.Server // set once started if redirecting HTTP to HTTPS
+	shutdown       bool         // set once Shutdown has been called
 }
 
 // PageEvent stores the JSON from an API call
@@ -39,81 +67,277 @@ type PageEvent struct {
 	OldHeight  int    `json:"oldHeight,omitempty"`
 	NewWidth   int    `json:"newWidth,omitempty"`
 	NewHeight  int    `json:"newHeight,omitempty"`
-	Pasted     bool   `json:"pasted,omitempty"`
+	Pasted     bool   `json:"pasted,omitempty"` // superseded by Action
+	Action     string `json:"action,omitempty"` // copy, cut or paste
+	Length     int    `json:"length,omitempty"` // number of characters pasted
 	FormID     string `json:"formId,omitempty"`
 	Time       int    `json:"time,omitempty"`
+	Intervals  []int  `json:"intervals,omitempty"`  // milliseconds between keystrokes
+	Keys       int    `json:"keys,omitempty"`       // number of keystrokes
+	Backspaces int    `json:"backspaces,omitempty"` // number of backspace (or delete) keystrokes
+
+	Received time.Time `json:"-"` // time the server received the event
+}
+
+// pageData is passed to the main page template
+type pageData struct {
+	*Data
+	APIKey string // tenant's public site key to send with events
+}
+
+// formSchema returns the current form schema
+func (s *Server) formSchema() *FormSchema {
+	if s.forms == nil {
+		return defaultFormSchema
+	}
+	return s.forms.Schema()
+}
+
+// formSchemaFor returns the current form schema for a tenant
+func (s *Server) formSchemaFor(tenant *Tenant) *FormSchema {
+	if tenant != nil && tenant.forms != nil {
+		return tenant.forms.Schema()
+	}
+	return s.formSchema()
+}
+
+// tenantFor returns the tenant a session belongs to, or nil if we have no tenants configured
+func (s *Server) tenantFor(data *Data) *Tenant {
+	if s.tenants == nil {
+		return nil
+	}
+	if t := s.tenants.LookupName(data.Tenant); t != nil {
+		return t
+	}
+	return s.tenants.Lookup(data.WebsiteURL)
+}
+
+// eventTenant returns the tenant an event was posted for, after checking the request is authorised
+// to post events for that tenant and was sent from the event's website (or an origin allowed to post for it).
+// Returns nil if we have no tenants configured.
+func (s *Server) eventTenant(request *http.Request, event *PageEvent) (*Tenant, error) {
+	if s.tenants == nil {
+		return nil, s.checkEventOrigin(request, nil, event)
+	}
+	tenant := s.tenants.Lookup(event.WebsiteURL)
+	if tenant == nil {
+		return nil, fmt.Errorf("unknown website: %s", event.WebsiteURL)
+	}
+	if err := tenant.authorize(request); err != nil {
+		tenant.count(counterRejected)
+		return nil, err
+	}
+	if err := s.checkEventOrigin(request, tenant, event); err != nil {
+		tenant.count(counterRejected)
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// requestSite returns the site (scheme and host) a request was sent to
+func requestSite(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + request.Host
+}
+
+// newSession creates a session for a page on a website, with a signed session ID if we issue them
+func (s *Server) newSession(website string) (*Data, error) {
+	if s.tokens == nil {
+		return s.sessionMgr.NewSession()
+	}
+	token, err := s.tokens.Issue(website)
+	if err != nil {
+		return nil, err
+	}
+	return s.sessionMgr.NewSessionWithID(token)
+}
+
+// lookupSession returns the session a request for a website was sent for. If we issue signed session IDs,
+// the ID is verified before the session is looked up, so we can tell IDs we never issued from expired sessions.
+// Rejected requests are logged and counted, and the error returned is suitable for the client.
+func (s *Server) lookupSession(sessionID, website string) (*Data, error) {
+	if s.tokens != nil {
+		if _, err := s.tokens.Verify(sessionID, website); err != nil {
+			log.Printf("INFO: Session ID rejected (%v): %s\n", err, sessionID)
+			s.metrics.sessionRejected(tokenRejectReason(err))
+			return nil, err
+		}
+	}
+	data, found := s.sessionMgr.Find(sessionID)
+	if !found {
+		if s.tokens != nil {
+			// we issued this ID, so the session must have been posted or expired
+			log.Printf("INFO: Expired session ID recieved: %s\n", sessionID)
+			s.metrics.sessionRejected("expired")
+			return nil, errSessionExpired
+		}
+		// session not found - invalid request or session has expired
+		log.Printf("INFO: Invalid or expired session ID recieved: %s\n", sessionID)
+		s.metrics.sessionRejected("unknown")
+		return nil, errSessionNotFound
+	}
+	return data, nil
+}
+
+// printUpdate sends the current data to the sink for its tenant (or our own sink) using the configured format.
+// The caller must hold the data's mutex.
+func (s *Server) printUpdate(data *Data, updateType string) {
+	sink := s.sink
+	if tenant := s.tenantFor(data); tenant != nil && tenant.sink != nil {
+		sink = tenant.sink
+	}
+	if sink == nil {
+		return
+	}
+	formatter := s.formatter
+	if formatter == nil {
+		formatter = TextFormatter{}
+	}
+	var record bytes.Buffer
+	if err := formatter.Format(&record, data, updateType); err != nil {
+		log.Printf("ERROR: Failed to format update: %v", err)
+		return
+	}
+	if err := sink.Send(record.Bytes()); err != nil {
+		log.Printf("ERROR: Failed to send update: %v", err)
+	}
 }
 
 // processEvent processes an event API call
-func (s *Server) processEvent(response http.ResponseWriter, request *http.Request, event *PageEvent, data *Data) {
+func (s *Server) processEvent(response http.ResponseWriter, request *http.Request, tenant *Tenant, event *PageEvent,
+	data *Data) {
+	status, err := s.applyEvent(tenant, event, data)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	s.metrics.countEvent(event.EventType, status)
+	response.WriteHeader(status)
+}
+
+// applyEvent validates an event posted for a tenant then applies it to the session's data.
+// Returns the HTTP status code for the result, with an error if the event was rejected.
+func (s *Server) applyEvent(tenant *Tenant, event *PageEvent, data *Data) (int, error) {
 	// we need to lock the Data as we can have concurrent requests from same page
 	data.mutex.Lock()
 	defer data.mutex.Unlock()
 
-	switch event.EventType {
-	case "resize":
-		data.SessionID = event.SessionID
-		data.ResizeFrom.Height = event.OldHeight
-		data.ResizeFrom.Width = event.OldWidth
-		data.ResizeTo.Height = event.NewHeight
-		data.ResizeTo.Width = event.NewWidth
-
-	case "copyAndPaste":
-		if _, found := validControls[event.FormID]; !found {
-			log.Printf("ERROR: Unexpected form ID: %s", event.FormID)
-			response.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		data.CopyAndPaste[event.FormID] = true
-
-	case "timeTaken":
-		data.FormCompletionTime = event.Time
-
-	default:
+	status, err := s.validateEvent(tenant, event, data)
+	if err != nil {
+		tenant.count(counterRejected)
+		return status, err
+	}
+	if event.Received.IsZero() {
+		event.Received = timeNow()
+	}
+	if err := data.applyEvent(event); err != nil {
 		// this shouldn't happen as events come from our own page
-		log.Printf("ERROR: Unexpected EventType: %s", event.EventType)
-		response.WriteHeader(http.StatusBadRequest)
-		return
+		tenant.count(counterRejected)
+		return http.StatusBadRequest, err
+	}
+	s.sessionMgr.Update(data.SessionID, event) // record the change while we still hold the lock
+	s.printUpdate(data, event.EventType)       // dump the current data to the screen
+	tenant.count(counterEvents)
+	return http.StatusOK, nil
+}
+
+// validateEvent checks an event is valid for the session it was posted to.
+// The caller must hold the data's mutex.
+func (s *Server) validateEvent(tenant *Tenant, event *PageEvent, data *Data) (int, error) {
+	if tenant != nil && len(data.Tenant) > 0 && data.Tenant != tenant.Name {
+		return http.StatusForbidden, fmt.Errorf("event for %s posted to session for tenant %s", event.WebsiteURL, data.Tenant)
+	}
+	if event.EventType == "copyAndPaste" || event.EventType == "keystrokes" {
+		// validate the field against the form this session was issued for
+		form := s.formSchemaFor(tenant).Form(data.FormID)
+		if form == nil {
+			return http.StatusBadRequest, fmt.Errorf("unknown form for session: %s", data.FormID)
+		}
+		if form.Field(event.FormID) == nil {
+			return http.StatusBadRequest, fmt.Errorf("unexpected form ID: %s", event.FormID)
+		}
 	}
-	data.WebsiteURL = event.WebsiteURL
-	data.PrintUpdate(s.outFile, event.EventType) // dump the current data to the screen
-	response.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
 }
 
 // processMainPageGet processes a GET on our main page
 // serve up our single page - note we create a new "session" for every load of the page
 // so the user interaction data we collect will be reset if the page is refreshed.
 func (s *Server) processMainPageGet(response http.ResponseWriter, request *http.Request) {
-	sessionData, err := s.sessionMgr.NewSession()
+	var tenant *Tenant
+	site := requestSite(request)
+	if s.tenants != nil {
+		if tenant = s.tenants.Lookup(site); tenant == nil {
+			log.Printf("INFO: Page requested for unknown website: %s\n", request.Host)
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	sessionData, err := s.newSession(site)
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	s.mainPageTemplate.Execute(response, sessionData)
+	page := pageData{Data: sessionData}
+	sessionData.mutex.Lock()
+	sessionData.FormID = s.formSchemaFor(tenant).DefaultForm
+	if tenant != nil {
+		sessionData.Tenant = tenant.Name
+		page.APIKey = tenant.APIKey
+	}
+	sessionData.mutex.Unlock()
+	tenant.count(counterSessions)
+	s.mainPageTemplate.Execute(response, page)
 }
 
 // processMainPagePost processes a POST on our main page
 func (s *Server) processMainPagePost(response http.ResponseWriter, request *http.Request) {
 	request.ParseForm()
 	sid := request.FormValue(sessionIDControl)
-	data, found := s.sessionMgr.Find(sid)
-	if !found {
-		// session not found - invalid request or session has expired
-		log.Printf("INFO: Invalid or expired session ID recieved: %s\n", sid)
+	data, err := s.lookupSession(sid, requestSite(request))
+	if err != nil {
 		response.WriteHeader(http.StatusForbidden)
 		return
 	}
-	data.PrintUpdate(s.outFile, "(Form Posted)")
+	data.mutex.Lock()
+	data.formPosted(timeNow())
+	if s.risk != nil {
+		data.Risk = s.risk.Assess(data)
+	}
+	highRisk := data.Risk != nil && data.Risk.HighRisk
+	s.printUpdate(data, "(Form Posted)")
+	s.metrics.sessionEnded(data, "posted")
+	data.mutex.Unlock()
+	s.tenantFor(data).count(counterPosted)
 	s.sessionMgr.Delete(sid) // delete this session once form is submitted
 
 	// we would normally process our posted data and redirect to suitable page here
 	// Instead for this test we'll just send a 201 status code
 	// in a new session (obviously not recommended on a real site!)
+	// High risk submissions are only accepted for review, so get a 202.
+	if highRisk {
+		response.WriteHeader(http.StatusAccepted)
+		return
+	}
 	response.WriteHeader(http.StatusCreated)
 }
 
+// sessionExpired is called when a session is evicted before the form was posted.
+// The partial data is still output so abandoned forms are recorded.
+func (s *Server) sessionExpired(data *Data) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	s.printUpdate(data, "(Expired)")
+	s.metrics.sessionEnded(data, "expired")
+	s.tenantFor(data).count(counterExpired)
+}
+
 // processMainPage processes a request for our 1 (and only) page on the site
 func (s *Server) processMainPage(response http.ResponseWriter, request *http.Request) {
+	defer s.metrics.requestHandled("mainPage", time.Now())
 	switch request.Method {
 	case "GET":
 		s.processMainPageGet(response, request)
@@ -146,24 +370,45 @@ func (s *Server) defaultHandler(response http.ResponseWriter, request *http.Requ
 
 // apiHandler processes API calls
 func (s *Server) apiHandler(response http.ResponseWriter, request *http.Request) {
+	defer s.metrics.requestHandled("api", time.Now())
 
 	switch request.Method {
 	case "POST":
+		// check the IP limit before doing any work, so throttled requests aren't counted in any session
+		if ok, retryAfter := s.ipLimiter.Allow(s.clientIP(request)); !ok {
+			log.Printf("INFO: Rate limit exceeded for %s\n", s.clientIP(request))
+			s.metrics.countEvent("", http.StatusTooManyRequests)
+			tooManyRequests(response, retryAfter)
+			return
+		}
 		event := &PageEvent{}
 		decoder := json.NewDecoder(request.Body)
 		if err := decoder.Decode(event); err != nil {
 			log.Printf("ERROR: Failed to decode request: %v\n", err)
+			s.metrics.countEvent("", http.StatusBadRequest)
 			response.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		data, found := s.sessionMgr.Find(event.SessionID)
-		if !found {
-			// session not found - invalid request or session has expired
-			log.Printf("INFO: Invalid or expired session ID recieved: %s\n", event.SessionID)
+		tenant, err := s.eventTenant(request, event)
+		if err != nil {
+			log.Printf("INFO: Event rejected: %v\n", err)
+			s.metrics.countEvent(event.EventType, http.StatusForbidden)
+			response.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, err := s.lookupSession(event.SessionID, event.WebsiteURL)
+		if err != nil {
+			s.metrics.countEvent(event.EventType, http.StatusForbidden)
 			response.WriteHeader(http.StatusForbidden)
 			return
 		}
-		s.processEvent(response, request, event, data)
+		if throttled, retryAfter := s.throttleSession(event.SessionID, data); throttled {
+			log.Printf("INFO: Rate limit exceeded for session %s\n", event.SessionID)
+			s.metrics.countEvent(event.EventType, http.StatusTooManyRequests)
+			tooManyRequests(response, retryAfter)
+			return
+		}
+		s.processEvent(response, request, tenant, event, data)
 
 	default:
 		log.Printf("ERROR: Invalid method type recieved in API: %s\n", request.Method)
@@ -176,12 +421,96 @@ func (s *Server) Init() {
 	s.mainPageTemplate = template.Must(template.ParseFiles("client/index.html"))
 }
 
-// Start setup our routes then starts listening on the required port
+// Handler returns our routes, wrapped in our middleware
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiURL, s.cors(s.apiHandler))
+	mux.HandleFunc(apiBatchURL, s.cors(s.apiBatchHandler))
+	mux.HandleFunc(metricsURL, s.metricsHandler)
+	mux.HandleFunc(adminURL, s.adminHandler)
+	//	mux.HandleFunc(mainPageURL, s.mainPageHandler)
+	mux.HandleFunc("/", s.defaultHandler)
+
+	middleware := s.Middleware
+	if middleware == nil {
+		middleware = DefaultMiddleware()
+	}
+	return chain(mux, middleware...)
+}
+
+// Start setup our routes then starts listening on the required port.
+// Returns http.ErrServerClosed once Shutdown has been called.
 func (s *Server) Start() error {
 	s.Init()
-	http.HandleFunc(apiURL, s.apiHandler)
-	//	http.HandleFunc(mainPageURL, s.mainPageHandler)
-	http.HandleFunc("/", s.defaultHandler)
+	handler := s.Handler()
+
+	s.mutex.Lock()
+	if s.shutdown {
+		s.mutex.Unlock()
+		return http.ErrServerClosed
+	}
+	s.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", s.Port), Handler: handler, TLSConfig: s.TLSConfig}
+	if s.TLSConfig != nil && s.RedirectPort > 0 {
+		s.redirectServer = &http.Server{Addr: fmt.Sprintf(":%d", s.RedirectPort), Handler: redirectToHTTPS(s.Port)}
+		go func(redirectServer *http.Server) {
+			log.Printf("Redirecting HTTP on port %d to HTTPS...", s.RedirectPort)
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("ERROR: Failed to redirect HTTP to HTTPS: %v", err)
+			}
+		}(s.redirectServer)
+	}
+	s.mutex.Unlock()
+
+	if s.TLSConfig != nil {
+		log.Printf("Listening for HTTPS on port %d...", s.Port)
+		return s.httpServer.ListenAndServeTLS("", "") // certificates are in TLSConfig
+	}
 	log.Printf("Listening on port %d...", s.Port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.Port), nil)
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits (up to timeout) for in-flight requests to complete,
+// then closes the session manager. Unless sessions are persisted, to be continued after a restart, every
+// open session is then output as "(Shutdown)" so partially completed forms are not lost.
+// Sessions are flushed even if the timeout expires, in which case the error is returned.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.mutex.Lock()
+	s.shutdown = true
+	httpServer, redirectServer := s.httpServer, s.redirectServer
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+	}
+	// stop expiring sessions first, so no session is output as both expired and shut down
+	s.sessionMgr.Close()
+	if s.sessionMgr.Persistent() {
+		log.Printf("INFO: Kept %d open sessions", s.sessionMgr.Count())
+		return err
+	}
+	n := s.flushSessions()
+	log.Printf("INFO: Flushed %d open sessions", n)
+	return err
+}
+
+// flushSessions outputs every open session as "(Shutdown)", oldest first, then deletes it.
+// Returns the number of sessions output.
+func (s *Server) flushSessions() int {
+	sessions := s.sessionMgr.Sessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	for _, info := range sessions {
+		info.Data.mutex.Lock()
+		s.printUpdate(info.Data, "(Shutdown)")
+		info.Data.mutex.Unlock()
+		s.sessionMgr.Delete(info.Data.SessionID)
+	}
+	return len(sessions)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"io/ioutil"
 	"log"
@@ -8,8 +9,10 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -25,7 +28,7 @@ const (
 
 // Create default test data to be returned by SessionManager
 func dftTestData() *Data {
-	return &Data{SessionID: testSessionID, CopyAndPaste: make(map[string]bool)}
+	return newData(testSessionID)
 }
 
 // serverTestCase defines  the inputs and expected response for a server call
@@ -55,6 +58,9 @@ type serverTestCase struct {
 
 	// test data to return (if null, non is returned, New and Find will fail)
 	testData *Data
+
+	// rules to score posted forms with (default to no scoring)
+	risk *RiskEngine
 }
 
 //	<a href="/index.html">See Other</a>
@@ -220,6 +226,93 @@ func TestServerAPICopyPasteBadControl(t *testing.T) {
 	testAPIRequest(t, apiRequest, http.StatusBadRequest)
 }
 
+func TestServerShutdown(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	var out bytes.Buffer
+	sm := CreateSessionManager()
+	server := &Server{sessionMgr: sm, sink: NewWriterSink(&out), formatter: LogfmtFormatter{}}
+	for i := 0; i < 2; i++ {
+		if _, err := sm.NewSession(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	started := make(chan error)
+	go func() { started <- server.Start() }()
+	time.Sleep(10 * time.Millisecond) // give the server a chance to start listening
+	if err := server.Shutdown(time.Second); err != nil {
+		t.Errorf("Failed to shut down: %v", err)
+	}
+	if err := <-started; err != http.ErrServerClosed {
+		t.Errorf("Unexpected error from Start: %v", err)
+	}
+	if n := strings.Count(out.String(), `updateType=(Shutdown) `); n != 2 {
+		t.Errorf("Expected 2 sessions flushed, got %d: %s", n, out.String())
+	}
+	if n := sm.Count(); n != 0 {
+		t.Errorf("Flushed sessions not deleted: %d", n)
+	}
+}
+
+func TestServerShutdownPersisted(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.log")
+
+	var out bytes.Buffer
+	server := &Server{sink: NewWriterSink(&out), formatter: LogfmtFormatter{}}
+	sm, err := CreateFileSessionManager(path, time.Hour, 0, 0, server.sessionExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.sessionMgr = sm
+	var ids []string
+	for i := 0; i < 2; i++ {
+		d, err := sm.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, d.SessionID)
+	}
+
+	started := make(chan error)
+	go func() { started <- server.Start() }()
+	time.Sleep(10 * time.Millisecond) // give the server a chance to start listening
+	if err := server.Shutdown(time.Second); err != nil {
+		t.Errorf("Failed to shut down: %v", err)
+	}
+	<-started
+	sm.Close() // as deferred by main
+	if out.Len() > 0 {
+		t.Errorf("Persisted sessions output on shutdown: %s", out.String())
+	}
+
+	// after a restart, each session is output once when it ends
+	sm2, err := CreateFileSessionManager(path, time.Hour, 0, 0, server.sessionExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm2.Close()
+	for _, id := range ids {
+		if !sm2.Expire(id) {
+			t.Errorf("Session %s not restored", id)
+		}
+	}
+	for _, id := range ids {
+		if n := strings.Count(out.String(), `sessionId="`+id+`"`); n != 1 {
+			t.Errorf("Expected session %s output once, got %d: %s", id, n, out.String())
+		}
+	}
+}
+
 //
 // Examples to ensure we are writing the correct results to the screen (and accumlating updates)
 //
@@ -235,6 +328,7 @@ func ExampleServerAPITimeTaken() {
 	//   SessionID: 1234ABCD5678
 	//   ResizeFrom: (0,0)
 	//   ResizeTo: (0,0)
+	//   Resizes: 0
 	//   copyAndPaste controls:
 	//   FormCompletionTime: 6 seconds
 	//   websiteURLHashCode: 2222077316
@@ -252,7 +346,8 @@ func ExampleServerAPICopyPaste() {
 	//   SessionID: 1234ABCD5678
 	//   ResizeFrom: (0,0)
 	//   ResizeTo: (0,0)
-	//   copyAndPaste controls: inputEmail
+	//   Resizes: 0
+	//   copyAndPaste controls: inputEmail (copy 1, cut 0, paste 0, pasted 0 chars)
 	//   FormCompletionTime: 0 seconds
 	//   websiteURLHashCode: 2222077316
 }
@@ -269,6 +364,7 @@ func ExampleServerAPIResize() {
 	//   SessionID: 1234ABCD5678
 	//   ResizeFrom: (500,600)
 	//   ResizeTo: (550,650)
+	//   Resizes: 1, min (500,600), max (550,650), orientation flips: 0
 	//   copyAndPaste controls:
 	//   FormCompletionTime: 0 seconds
 	//   websiteURLHashCode: 2222077316
@@ -288,15 +384,22 @@ type MockSessionManager struct {
 	newSessionFn func() (*Data, error)
 	findFn       func(sessionID string) (*Data, bool)
 	deleteFn     func(sessionID string)
+	updateFn     func(sessionID string, event *PageEvent)
+	throttledFn  func(sessionID string)
+	countFn      func() int
+	sessionsFn   func() []SessionInfo
+	expireFn     func(sessionID string) bool
 
 	// track number of times each method is called
 	newSessionCalls int
 	findCalls       int
 	deleteCalls     int
+	updateCalls     int
 
 	// track parameters for last call made
 	findInput   string
 	deleteInput string
+	updateInput *PageEvent
 }
 
 func (s *MockSessionManager) NewSession() (*Data, error) {
@@ -307,6 +410,14 @@ func (s *MockSessionManager) NewSession() (*Data, error) {
 	return nil, nil
 }
 
+func (s *MockSessionManager) NewSessionWithID(sessionID string) (*Data, error) {
+	d, err := s.NewSession()
+	if d != nil {
+		d.SessionID = sessionID
+	}
+	return d, err
+}
+
 func (s *MockSessionManager) Find(sessionID string) (*Data, bool) {
 	s.findCalls++
 	s.findInput = sessionID
@@ -324,6 +435,48 @@ func (s *MockSessionManager) Delete(sessionID string) {
 	}
 }
 
+func (s *MockSessionManager) Update(sessionID string, event *PageEvent) {
+	s.updateCalls++
+	s.updateInput = event
+	if s.updateFn != nil {
+		s.updateFn(sessionID, event)
+	}
+}
+
+func (s *MockSessionManager) Throttled(sessionID string) {
+	if s.throttledFn != nil {
+		s.throttledFn(sessionID)
+	}
+}
+
+func (s *MockSessionManager) Count() int {
+	if s.countFn != nil {
+		return s.countFn()
+	}
+	return 0
+}
+
+func (s *MockSessionManager) Sessions() []SessionInfo {
+	if s.sessionsFn != nil {
+		return s.sessionsFn()
+	}
+	return nil
+}
+
+func (s *MockSessionManager) Expire(sessionID string) bool {
+	if s.expireFn != nil {
+		return s.expireFn(sessionID)
+	}
+	return false
+}
+
+func (s *MockSessionManager) Persistent() bool {
+	return false
+}
+
+func (s *MockSessionManager) Close() {
+}
+
 // test a POST request to the API and ensure expected response
 func testAPIRequest(t *testing.T, requestJSON string, expectedStatus int) {
 	test := &serverTestCase{
@@ -391,8 +544,11 @@ func testServerRequest(t *testing.T, tc *serverTestCase) {
 	}
 
 	server := &Server{
-		outFile:    tc.outFile,
 		sessionMgr: mockSM,
+		risk:       tc.risk,
+	}
+	if tc.outFile != nil {
+		server.sink = NewWriterSink(tc.outFile)
 	}
 	server.Init()
 
@@ -3,33 +3,94 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"sync"
+	"time"
 )
 
+// timeNow returns the current time (replaced in tests)
+var timeNow = time.Now
+
 // SessionManager is an interface to maintains a map of session ids to Session types
 // Note that a session is used to store types of type "Data"
 type SessionManager interface {
 	NewSession() (*Data, error)
+	NewSessionWithID(sessionID string) (*Data, error) // as NewSession, using a session ID we've issued
 	Find(sessionID string) (*Data, bool)
 	Delete(sessionID string)
+	Update(sessionID string, event *PageEvent) // called with the Data locked after an event is applied
+	Throttled(sessionID string)                // called with the Data locked after an event is throttled
+	Count() int                                // number of active sessions
+	Sessions() []SessionInfo                   // all sessions held, in no particular order
+	Expire(sessionID string) bool              // evict a session as if it had expired, returns false if not found
+	Persistent() bool                          // true if sessions survive a restart
+	Close()                                    // stop expiring sessions and close any store
+}
+
+// SessionInfo describes a session held by a SessionManager
+type SessionInfo struct {
+	Data         *Data
+	Created      time.Time
+	LastActivity time.Time
 }
 
 // CreateSessionManager returns a new SessionManger implementation
 func CreateSessionManager() SessionManager {
+	return newDataSessionManager()
+}
+
+// CreateExpiringSessionManager returns a new SessionManager which evicts sessions that have been idle for
+// longer than idleTTL, or that were created more than maxLifetime ago (a zero duration disables that check).
+// Each evicted session is passed to onExpire (if not nil) so partially completed data is not lost.
+// A background reaper is started which runs until Close is called.
+func CreateExpiringSessionManager(idleTTL, maxLifetime time.Duration, onExpire func(*Data)) *DataSessionManager {
+	m := newDataSessionManager()
+	m.idleTTL = idleTTL
+	m.maxLifetime = maxLifetime
+	m.onExpire = onExpire
+	if interval := m.reapInterval(); interval > 0 {
+		m.reaping.Add(1)
+		go m.reaper(interval)
+	}
+	return m
+}
+
+func newDataSessionManager() *DataSessionManager {
 	return &DataSessionManager{
 		sessions: make(map[string]*Session),
+		done:     make(chan struct{}),
 	}
 }
 
 // Session stores all the per session data we require
 type Session struct {
-	data *Data // our tracked data for this session
+	data         *Data     // our tracked data for this session
+	created      time.Time // time the session was created
+	lastActivity time.Time // time the session was last found
+}
+
+// expired returns true if the session has exceeded either the idle or absolute lifetime limits
+func (s *Session) expired(now time.Time, idleTTL, maxLifetime time.Duration) bool {
+	if idleTTL > 0 && now.Sub(s.lastActivity) > idleTTL {
+		return true
+	}
+	if maxLifetime > 0 && now.Sub(s.created) > maxLifetime {
+		return true
+	}
+	return false
 }
 
 // DataSessionManager is a thread safe type implementing the SessionManger interface
 type DataSessionManager struct {
 	sessions map[string]*Session
 	mutex    sync.Mutex
+
+	idleTTL     time.Duration // maximum time between accesses (0 for no limit)
+	maxLifetime time.Duration // maximum absolute lifetime (0 for no limit)
+	onExpire    func(*Data)   // called for each session evicted by the reaper
+	done        chan struct{} // closed to stop the reaper
+	reaping     sync.WaitGroup
+	closeOnce   sync.Once
 }
 
 // NewSession creates a new session with a random session id and adds it to
@@ -39,20 +100,32 @@ func (m *DataSessionManager) NewSession() (*Data, error) {
 	if err != nil {
 		return nil, err
 	}
+	return m.NewSessionWithID(id)
+}
+
+// NewSessionWithID creates a new session with the given session id and adds it to this session manager.
+// Returns the new Data on success, or an error if the id is already in use.
+func (m *DataSessionManager) NewSessionWithID(id string) (*Data, error) {
+	now := timeNow()
 	d := &Session{
-		&Data{SessionID: id,
-			CopyAndPaste: make(map[string]bool),
-		},
+		data:         newData(id),
+		created:      now,
+		lastActivity: now,
 	}
+	d.data.Timing.Created = now
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	if _, exists := m.sessions[id]; exists {
+		return nil, fmt.Errorf("duplicate session ID: %s", id)
+	}
 	m.sessions[id] = d
 	return d.data, nil
 }
 
 // Find returns the Data stored for the given SessionID or nil if none exists
 // Returns the session if found, and a flag to indicate success
+// Finding a session counts as activity and resets its idle timer.
 func (m *DataSessionManager) Find(sessionID string) (*Data, bool) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -60,6 +133,11 @@ func (m *DataSessionManager) Find(sessionID string) (*Data, bool) {
 	if s == nil || !ok {
 		return nil, false
 	}
+	now := timeNow()
+	if s.expired(now, m.idleTTL, m.maxLifetime) {
+		return nil, false // leave it for the reaper to report
+	}
+	s.lastActivity = now
 	return s.data, true
 }
 
@@ -70,6 +148,108 @@ func (m *DataSessionManager) Delete(sessionID string) {
 	delete(m.sessions, sessionID)
 }
 
+// Update records that an event has been applied to a session's Data.
+// Nothing is required as we only hold sessions in memory.
+func (m *DataSessionManager) Update(sessionID string, event *PageEvent) {
+}
+
+// Throttled records that an event was rejected by a session's rate limit.
+// Nothing is required as we only hold sessions in memory.
+func (m *DataSessionManager) Throttled(sessionID string) {
+}
+
+// Count returns the number of sessions held (including any expired but not yet reaped)
+func (m *DataSessionManager) Count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.sessions)
+}
+
+// Sessions returns a snapshot of all sessions held (including any expired but not yet reaped).
+// Listing sessions doesn't count as activity.
+func (m *DataSessionManager) Sessions() []SessionInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sessions := make([]SessionInfo, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, SessionInfo{Data: s.data, Created: s.created, LastActivity: s.lastActivity})
+	}
+	return sessions
+}
+
+// Expire removes a session and passes it to onExpire, as if it had been reaped.
+// Returns false if the session was not found.
+func (m *DataSessionManager) Expire(sessionID string) bool {
+	m.mutex.Lock()
+	s, ok := m.sessions[sessionID]
+	delete(m.sessions, sessionID)
+	m.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	if m.onExpire != nil {
+		m.onExpire(s.data)
+	}
+	return true
+}
+
+// Persistent returns false as we only hold sessions in memory
+func (m *DataSessionManager) Persistent() bool {
+	return false
+}
+
+// Close stops the background reaper (if running), waiting for any sessions being expired to be reported
+func (m *DataSessionManager) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+	m.reaping.Wait()
+}
+
+// reapInterval returns how often the reaper should run, or 0 if sessions never expire
+func (m *DataSessionManager) reapInterval() time.Duration {
+	interval := m.idleTTL
+	if interval <= 0 || (m.maxLifetime > 0 && m.maxLifetime < interval) {
+		interval = m.maxLifetime
+	}
+	return interval / 2
+}
+
+// reaper periodically evicts expired sessions until the manager is closed
+func (m *DataSessionManager) reaper(interval time.Duration) {
+	defer m.reaping.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.reapExpired(timeNow())
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// reapExpired removes all sessions which have expired at the given time and passes them to onExpire.
+// Returns the number of sessions removed.
+func (m *DataSessionManager) reapExpired(now time.Time) int {
+	var expired []*Data
+	m.mutex.Lock()
+	for id, s := range m.sessions {
+		if s.expired(now, m.idleTTL, m.maxLifetime) {
+			expired = append(expired, s.data)
+			delete(m.sessions, id)
+		}
+	}
+	m.mutex.Unlock()
+
+	// report outside of our lock so a slow output doesn't block new sessions
+	if m.onExpire != nil {
+		for _, d := range expired {
+			m.onExpire(d)
+		}
+	}
+	return len(expired)
+}
+
 // makeSessionId generate a new random session id
 func makeSessionID() (string, error) {
 	key := make([]byte, 64)
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestSessionMangerAddFindDelete(t *testing.T) {
 
@@ -53,3 +56,50 @@ func TestSessionMangerAddFindDelete(t *testing.T) {
 		t.Errorf("SessionManger: Found deleted session! (%s, %p)", s2.SessionID, s)
 	}
 }
+
+func TestSessionManagerExpiry(t *testing.T) {
+
+	start := time.Now()
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	var expired []*Data
+	sm := CreateExpiringSessionManager(time.Minute, 5*time.Minute, func(d *Data) { expired = append(expired, d) })
+	sm.Close() // we drive the reaper manually
+
+	idle, err := sm.NewSession()
+	if err != nil {
+		t.Fatalf("SessionManger: Failed to create new session! (%v)", err)
+	}
+	active, err := sm.NewSession()
+	if err != nil {
+		t.Fatalf("SessionManger: Failed to create new session! (%v)", err)
+	}
+
+	// keep one session active while the other goes idle
+	for i := 0; i < 4; i++ {
+		now = now.Add(50 * time.Second)
+		if _, found := sm.Find(active.SessionID); !found {
+			t.Fatalf("SessionManger: Active session expired early! (%s)", active.SessionID)
+		}
+	}
+	if _, found := sm.Find(idle.SessionID); found {
+		t.Errorf("SessionManger: Found idle session! (%s)", idle.SessionID)
+	}
+	if n := sm.reapExpired(now); n != 1 || len(expired) != 1 || expired[0] != idle {
+		t.Errorf("SessionManger: Expected idle session to be reaped, reaped %d (%v)", n, expired)
+	}
+
+	// now exceed the absolute lifetime of the active session
+	for now.Sub(start) <= 5*time.Minute {
+		sm.Find(active.SessionID)
+		now = now.Add(30 * time.Second)
+	}
+	if n := sm.reapExpired(now); n != 1 || len(expired) != 2 || expired[1] != active {
+		t.Errorf("SessionManger: Expected active session to be reaped, reaped %d (%v)", n, expired)
+	}
+	if n := sm.reapExpired(now); n != 0 {
+		t.Errorf("SessionManger: Unexpected sessions reaped: %d", n)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventSink is an interface to a destination for formatted updates.
+// Each call to Send is passed a single complete record.
+type EventSink interface {
+	Send(record []byte) error
+	Close() error
+}
+
+// SinkConfig holds the options used when creating sinks from a specification
+type SinkConfig struct {
+	ContentType string // content type of records (sent to webhooks)
+	RotateSize  int64  // size in bytes at which files are rotated (0 to never rotate)
+	RotateKeep  int    // number of rotated files to keep
+	BufferSize  int    // number of records buffered per sink (0 for unbuffered)
+}
+
+// CreateEventSink creates a sink from a specification, which is one of:
+//
+//	stdout				- write to standard output
+//	file:<path>			- append to a file, rotating as configured
+//	unix:<path>			- write to a Unix domain socket
+//	http(s)://<url>		- POST each record to a webhook
+//
+// The sink is buffered if required so that a slow sink never blocks the caller.
+func CreateEventSink(spec string, config SinkConfig) (EventSink, error) {
+	var sink EventSink
+	var err error
+	switch {
+	case spec == "stdout":
+		sink = NewWriterSink(os.Stdout)
+	case strings.HasPrefix(spec, "file:"):
+		sink, err = NewRotatingFileSink(strings.TrimPrefix(spec, "file:"), config.RotateSize, config.RotateKeep)
+	case strings.HasPrefix(spec, "unix:"):
+		sink = NewSocketSink(strings.TrimPrefix(spec, "unix:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		sink = NewWebhookSink(spec, config.ContentType)
+	default:
+		err = fmt.Errorf("unknown event sink: %s", spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.BufferSize > 0 {
+		sink = NewBufferedSink(sink, config.BufferSize)
+	}
+	return sink, nil
+}
+
+//
+// WriterSink
+//
+
+// WriterSink sends records to an io.Writer (e.g. stdout)
+type WriterSink struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewWriterSink returns a sink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Send writes the record
+func (s *WriterSink) Send(record []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.w.Write(record)
+	return err
+}
+
+// Close has no effect (we don't own the writer)
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+//
+// RotatingFileSink
+//
+
+// RotatingFileSink appends records to a file. When the file would exceed maxSize it is renamed
+// to <path>.1 (with older files becoming <path>.2 etc, up to keep files) and a new file started.
+type RotatingFileSink struct {
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+	mutex   sync.Mutex
+}
+
+// NewRotatingFileSink opens (or creates) the file at path for appending
+func NewRotatingFileSink(path string, maxSize int64, keep int) (*RotatingFileSink, error) {
+	s := &RotatingFileSink{path: path, maxSize: maxSize, keep: keep}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RotatingFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file (and older files) then starts a new file
+func (s *RotatingFileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	if s.keep <= 0 {
+		os.Remove(s.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.keep))
+		for i := s.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	}
+	return s.open()
+}
+
+// Send appends the record, rotating the file first if required
+func (s *RotatingFileSink) Send(record []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(record)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(record)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the file
+func (s *RotatingFileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+//
+// SocketSink
+//
+
+// SocketSink writes records to a Unix domain socket, (re)connecting as required
+type SocketSink struct {
+	path  string
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+// NewSocketSink returns a sink writing to the Unix domain socket at path.
+// The connection is made when the first record is sent.
+func NewSocketSink(path string) *SocketSink {
+	return &SocketSink{path: path}
+}
+
+// Send writes the record to the socket. If the write fails we reconnect and retry once.
+func (s *SocketSink) Send(record []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if s.conn, err = net.Dial("unix", s.path); err != nil {
+				s.conn = nil
+				return err
+			}
+		}
+		if _, err = s.conn.Write(record); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// Close closes the connection (if open)
+func (s *SocketSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+//
+// WebhookSink
+//
+
+const webhookTimeout = 10 * time.Second
+
+// WebhookSink POSTs each record to a URL
+type WebhookSink struct {
+	url         string
+	contentType string
+	client      *http.Client
+}
+
+// NewWebhookSink returns a sink posting records to url
+func NewWebhookSink(url string, contentType string) *WebhookSink {
+	if len(contentType) == 0 {
+		contentType = "text/plain"
+	}
+	return &WebhookSink{
+		url:         url,
+		contentType: contentType,
+		client:      &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Send posts the record, returning an error if the webhook does not return a 2xx status
+func (s *WebhookSink) Send(record []byte) error {
+	resp, err := s.client.Post(s.url, s.contentType, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned status %d", s.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// Close has no effect
+func (s *WebhookSink) Close() error {
+	return nil
+}
+
+//
+// MultiSink
+//
+
+// MultiSink sends each record to all of a set of sinks
+type MultiSink []EventSink
+
+// Send sends the record to every sink, returning the first error (if any)
+func (m MultiSink) Send(record []byte) error {
+	var first error
+	for _, s := range m {
+		if err := s.Send(record); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close closes every sink, returning the first error (if any)
+func (m MultiSink) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//
+// BufferedSink
+//
+
+// BufferedSink queues records for a sink and sends them from a background goroutine, so
+// a slow sink never blocks the caller. If the queue is full the record is dropped.
+type BufferedSink struct {
+	sink    EventSink
+	queue   chan []byte
+	done    chan struct{}
+	dropped uint64
+	mutex   sync.Mutex // guards dropped and closed
+	closed  bool
+}
+
+// NewBufferedSink returns a sink queuing up to size records for sink
+func NewBufferedSink(sink EventSink, size int) *BufferedSink {
+	b := &BufferedSink{
+		sink:  sink,
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *BufferedSink) run() {
+	defer close(b.done)
+	for record := range b.queue {
+		if err := b.sink.Send(record); err != nil {
+			log.Printf("ERROR: Failed to send update: %v", err)
+		}
+	}
+}
+
+// Send queues a copy of the record without blocking
+func (b *BufferedSink) Send(record []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return os.ErrClosed
+	}
+	select {
+	case b.queue <- append([]byte(nil), record...):
+		return nil
+	default:
+		b.dropped++
+		return fmt.Errorf("event sink buffer full: %d records dropped", b.dropped)
+	}
+}
+
+// Dropped returns the number of records dropped because the buffer was full
+func (b *BufferedSink) Dropped() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.dropped
+}
+
+// Close waits for all queued records to be sent then closes the underlying sink
+func (b *BufferedSink) Close() error {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mutex.Unlock()
+	<-b.done
+	return b.sink.Close()
+}
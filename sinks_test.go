@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateEventSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, spec := range []string{"stdout", "file:" + filepath.Join(dir, "out.log"), "unix:/tmp/none.sock", "http://localhost/hook"} {
+		sink, err := CreateEventSink(spec, SinkConfig{BufferSize: 1})
+		if err != nil || sink == nil {
+			t.Errorf("Failed to create sink %s: %v", spec, err)
+			continue
+		}
+		sink.Close()
+	}
+	if _, err := CreateEventSink("ftp://localhost", SinkConfig{}); err == nil {
+		t.Errorf("Created sink for unknown specification")
+	}
+}
+
+func TestRotatingFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	sink, err := NewRotatingFileSink(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"zero\n", "one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		if err := sink.Send([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	// each file is started when the next record would take it over 10 bytes
+	expected := map[string]string{
+		path:        "six\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "two\nthree\n",
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected oldest file to be removed: %v", err)
+	}
+	for file, contents := range expected {
+		b, err := ioutil.ReadFile(file)
+		if err != nil || string(b) != contents {
+			t.Errorf("Unexpected contents for %s: expected %q, got %q (%v)", file, contents, b, err)
+		}
+	}
+}
+
+func TestSocketSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	sink := NewSocketSink(path)
+	defer sink.Close()
+	if err := sink.Send([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-received:
+		if line != "hello\n" {
+			t.Errorf("Unexpected record from socket: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for socket record")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var body []byte
+	var contentType string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, "application/x-ndjson")
+	if err := sink.Send([]byte(`{"updateType":"resize"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"updateType":"resize"}` || contentType != "application/x-ndjson" {
+		t.Errorf("Unexpected webhook request: %s (%s)", body, contentType)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.Send([]byte(`{}`)); err == nil {
+		t.Errorf("Expected error from failing webhook")
+	}
+}
+
+// blockingSink is an EventSink which blocks until released
+type blockingSink struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	records []string
+}
+
+func (s *blockingSink) Send(record []byte) error {
+	<-s.release
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, string(record))
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestBufferedSinkNeverBlocks(t *testing.T) {
+	slow := &blockingSink{release: make(chan struct{})}
+	var out bytes.Buffer
+	sink := MultiSink{NewBufferedSink(slow, 2), NewWriterSink(&out)}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			sink.Send([]byte{byte('0' + i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send blocked on a slow sink")
+	}
+
+	// the fast sink receives everything, the slow one what fitted in its buffer
+	close(slow.release)
+	sink.Close()
+	if out.String() != "0123456789" {
+		t.Errorf("Unexpected records in fast sink: %s", out.String())
+	}
+	if dropped := sink[0].(*BufferedSink).Dropped(); len(slow.records)+int(dropped) != 10 || len(slow.records) < 2 {
+		t.Errorf("Unexpected records in slow sink: %v (%d dropped)", slow.records, dropped)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// SipHash-2-4 (https://www.aumasson.jp/siphash/) is a keyed hash: without the key, nobody can find strings
+// whose hash codes collide. We use it (with a random key for each process) for hash codes used as map keys,
+// so clients can't degrade our maps by sending many colliding website URLs (hash-flooding).
+
+const (
+	sipInit0 = 0x736f6d6570736575 // "somepseu"
+	sipInit1 = 0x646f72616e646f6d // "dorandom"
+	sipInit2 = 0x6c7967656e657261 // "lygenera"
+	sipInit3 = 0x7465646279746573 // "tedbytes"
+)
+
+// sipHashKey is our per-process random key, used by HashStringKeyed
+var sipHashKey = newSipHashKey()
+
+// newSipHashKey generates a random key
+func newSipHashKey() [16]byte {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err) // we can't safely continue without a random key
+	}
+	return key
+}
+
+// HashStringKeyed calculates a 64 bit SipHash-2-4 hash code for a supplied string, using our per-process key.
+// Use this rather than HashString for hash codes used as map keys. The codes are different for every process
+// so must not be output or stored.
+func HashStringKeyed(str string) uint64 {
+	hasher := CreateSipHash64(sipHashKey)
+	hasher.Write([]byte(str))
+	return hasher.Sum64()
+}
+
+// SipHash64 type implements the standard hash.Hash64 interface using SipHash-2-4
+type SipHash64 struct {
+	k0, k1         uint64  // key
+	v0, v1, v2, v3 uint64  // state
+	length         int     // total bytes written
+	buf            [8]byte // partial block
+	n              int     // bytes in buf
+}
+
+// CreateSipHash64 creates a new Hash64 implementation of SipHash-2-4 with the given key
+func CreateSipHash64(key [16]byte) hash.Hash64 {
+	h := &SipHash64{
+		k0: binary.LittleEndian.Uint64(key[:8]),
+		k1: binary.LittleEndian.Uint64(key[8:]),
+	}
+	h.Reset()
+	return h
+}
+
+// sipRound is one SipRound of the state
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
+
+// compress mixes one 8 byte message word into the state, with 2 SipRounds
+func (h *SipHash64) compress(m uint64) {
+	v0, v1, v2, v3 := h.v0, h.v1, h.v2, h.v3^m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	h.v0, h.v1, h.v2, h.v3 = v0^m, v1, v2, v3
+}
+
+// Write takes a sequence of bytes to hash and accumulates the hash code
+// Returns the number of bytes processed (all of them)
+func (h *SipHash64) Write(b []byte) (int, error) {
+	length := len(b)
+	h.length += length
+	if h.n > 0 {
+		copied := copy(h.buf[h.n:], b)
+		h.n += copied
+		b = b[copied:]
+		if h.n < len(h.buf) {
+			return length, nil
+		}
+		h.compress(binary.LittleEndian.Uint64(h.buf[:]))
+		h.n = 0
+	}
+	for ; len(b) >= 8; b = b[8:] {
+		h.compress(binary.LittleEndian.Uint64(b))
+	}
+	h.n = copy(h.buf[:], b)
+	return length, nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *SipHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+// Reset resets the Hash to its initial state.
+func (h *SipHash64) Reset() {
+	h.v0 = h.k0 ^ sipInit0
+	h.v1 = h.k1 ^ sipInit1
+	h.v2 = h.k0 ^ sipInit2
+	h.v3 = h.k1 ^ sipInit3
+	h.length = 0
+	h.n = 0
+}
+
+// Size returns the number of bytes Sum will return.
+func (h *SipHash64) Size() int {
+	return 8
+}
+
+// BlockSize returns the hash's underlying block size.
+func (h *SipHash64) BlockSize() int {
+	return 8
+}
+
+// Sum64 returns the hash code
+func (h *SipHash64) Sum64() uint64 {
+	// the final block holds the remaining bytes, with the length (mod 256) in the top byte
+	m := uint64(h.length) << 56
+	for i := h.n - 1; i >= 0; i-- {
+		m |= uint64(h.buf[i]) << (uint(i) * 8)
+	}
+
+	v0, v1, v2, v3 := h.v0, h.v1, h.v2, h.v3^m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= m
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSipHash64(t *testing.T) {
+	// vectors from the SipHash reference implementation: key 00 01 .. 0f, message 00 01 .. (length-1)
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	message := make([]byte, 64)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	tests := []struct {
+		length   int
+		expected uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{2, 0x0d6c8009d9a94f5a},
+		{3, 0x85676696d7fb7e2d},
+		{15, 0xa129ca6149be45e5},
+	}
+	h := CreateSipHash64(key)
+	if h.Size() != 8 || h.BlockSize() != 8 {
+		t.Fatalf("Incorrect size %d, block size %d", h.Size(), h.BlockSize())
+	}
+	for _, test := range tests {
+		writeInParts(string(message[:test.length]), h, func(split int) {
+			if h.Sum64() != test.expected {
+				t.Errorf("Incorrect hash code for %d bytes (split at %d), expected %016x, got %016x",
+					test.length, split, test.expected, h.Sum64())
+			}
+		})
+	}
+}
+
+func TestHashStringKeyed(t *testing.T) {
+	if HashStringKeyed("https://shop.example.com") != HashStringKeyed("https://shop.example.com") {
+		t.Errorf("Keyed hash code not repeatable")
+	}
+	// with another key, the same string has a different hash code
+	h := CreateSipHash64(newSipHashKey())
+	h.Write([]byte("https://shop.example.com"))
+	if h.Sum64() == HashStringKeyed("https://shop.example.com") {
+		t.Errorf("Keyed hash code doesn't depend on the key")
+	}
+}
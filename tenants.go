@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// apiKeyHeader is the request header carrying a tenant's API key.
+// The key is public - it's served to every visitor in the tenant's pages - so it only identifies which tenant
+// a page was served for. Events are authenticated by their signed session ID (see TokenSigner) and origin.
+const apiKeyHeader = "X-Api-Key"
+
+// TenantConfig is the configuration of a single tenant website
+type TenantConfig struct {
+	Name           string   `json:"name"`
+	WebsiteURL     string   `json:"websiteUrl"`               // site the tenant's pages are served from (e.g. https://shop.example.com)
+	Default        bool     `json:"default,omitempty"`        // use this tenant for any unknown website
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"` // origins allowed to post events (default the website's origin)
+	Forms          string   `json:"forms,omitempty"`          // form schema file (default the server's forms)
+	Sinks          []string `json:"sinks,omitempty"`          // output destinations (default the server's sinks)
+	APIKey         string   `json:"apiKey,omitempty"`         // public site key required in the X-Api-Key header of API calls (if set) - not a secret
+}
+
+// per tenant counters
+const (
+	counterSessions = iota // sessions created
+	counterEvents          // events accepted
+	counterRejected        // events rejected
+	counterPosted          // forms posted
+	counterExpired         // sessions expired
+	numCounters
+)
+
+// TenantCounters is a snapshot of a tenant's counters
+type TenantCounters struct {
+	Sessions uint64 `json:"sessions"`
+	Events   uint64 `json:"events"`
+	Rejected uint64 `json:"rejected"`
+	Posted   uint64 `json:"posted"`
+	Expired  uint64 `json:"expired"`
+}
+
+// Tenant is a website we capture events for
+type Tenant struct {
+	TenantConfig
+
+	site     string        // canonical site (scheme://host) used as our key
+	forms    *FormRegistry // nil to use the server's forms
+	sink     EventSink     // nil to use the server's sink
+	counters [numCounters]uint64
+}
+
+// count increments one of the tenant's counters (no effect on a nil Tenant)
+func (t *Tenant) count(counter int) {
+	if t != nil {
+		atomic.AddUint64(&t.counters[counter], 1)
+	}
+}
+
+// Counters returns a snapshot of the tenant's counters
+func (t *Tenant) Counters() TenantCounters {
+	return TenantCounters{
+		Sessions: atomic.LoadUint64(&t.counters[counterSessions]),
+		Events:   atomic.LoadUint64(&t.counters[counterEvents]),
+		Rejected: atomic.LoadUint64(&t.counters[counterRejected]),
+		Posted:   atomic.LoadUint64(&t.counters[counterPosted]),
+		Expired:  atomic.LoadUint64(&t.counters[counterExpired]),
+	}
+}
+
+// originAllowed returns true if events may be posted from a page with the given origin
+func (t *Tenant) originAllowed(origin string) bool {
+	if len(t.AllowedOrigins) == 0 {
+		return siteKey(origin) == t.site
+	}
+	return originListed(t.AllowedOrigins, origin)
+}
+
+// authorize checks an API request is allowed to post events for this tenant: it must carry the tenant's
+// site key (if set) and come from an allowed origin. Neither is a secret, so this only stops events sent for
+// the wrong tenant (e.g. from a misconfigured page) - it doesn't authenticate the sender.
+func (t *Tenant) authorize(request *http.Request) error {
+	if len(t.APIKey) > 0 && request.Header.Get(apiKeyHeader) != t.APIKey {
+		return fmt.Errorf("site key does not match tenant %s", t.Name)
+	}
+	if origin := request.Header.Get("Origin"); len(origin) > 0 && !t.originAllowed(origin) {
+		return fmt.Errorf("origin %s not allowed for tenant %s", origin, t.Name)
+	}
+	return nil
+}
+
+// siteKey returns the canonical scheme and host of a URL (see CanonicalURL), which identifies the website it belongs to
+func siteKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || len(u.Host) == 0 {
+		return ""
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme + "://" + canonicalHost(scheme, u.Host)
+}
+
+// TenantRegistry holds all configured tenants, keyed by the hash of their website
+type TenantRegistry struct {
+	tenants       []*Tenant
+	bySite        map[uint64][]*Tenant // HashStringKeyed(site) -> tenants
+	byName        map[string]*Tenant
+	defaultTenant *Tenant
+}
+
+// CreateTenantRegistry creates a registry from the supplied configurations.
+// Tenant sinks are created using sinkConfig.
+func CreateTenantRegistry(configs []TenantConfig, sinkConfig SinkConfig) (*TenantRegistry, error) {
+	r := &TenantRegistry{
+		bySite: make(map[uint64][]*Tenant),
+		byName: make(map[string]*Tenant),
+	}
+	for _, config := range configs {
+		t, err := r.add(config, sinkConfig)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.tenants = append(r.tenants, t)
+	}
+	return r, nil
+}
+
+func (r *TenantRegistry) add(config TenantConfig, sinkConfig SinkConfig) (*Tenant, error) {
+	t := &Tenant{TenantConfig: config, site: siteKey(config.WebsiteURL)}
+	if len(t.Name) == 0 {
+		return nil, fmt.Errorf("tenant with no name")
+	}
+	if _, found := r.byName[t.Name]; found {
+		return nil, fmt.Errorf("duplicate tenant name: %s", t.Name)
+	}
+	if len(t.site) == 0 {
+		return nil, fmt.Errorf("invalid website URL for tenant %s: %q", t.Name, config.WebsiteURL)
+	}
+	if r.lookupSite(t.site) != nil {
+		return nil, fmt.Errorf("duplicate website URL for tenant %s: %s", t.Name, config.WebsiteURL)
+	}
+	if config.Default {
+		if r.defaultTenant != nil {
+			return nil, fmt.Errorf("more than one default tenant: %s, %s", r.defaultTenant.Name, t.Name)
+		}
+		r.defaultTenant = t
+	}
+
+	if len(config.Forms) > 0 {
+		forms, err := CreateFormRegistry(config.Forms)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+		}
+		t.forms = forms
+	}
+	if len(config.Sinks) > 0 {
+		var sinks MultiSink
+		for _, spec := range config.Sinks {
+			sink, err := CreateEventSink(spec, sinkConfig)
+			if err != nil {
+				sinks.Close()
+				return nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+			}
+			sinks = append(sinks, sink)
+		}
+		t.sink = sinks
+	}
+
+	hc := HashStringKeyed(t.site)
+	r.bySite[hc] = append(r.bySite[hc], t)
+	r.byName[t.Name] = t
+	return t, nil
+}
+
+// LoadTenantRegistry loads the tenant configurations from a JSON file
+func LoadTenantRegistry(path string, sinkConfig SinkConfig) (*TenantRegistry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config struct {
+		Tenants []TenantConfig `json:"tenants"`
+	}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	r, err := CreateTenantRegistry(config.Tenants, sinkConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// lookupSite returns the tenant for a site key, or nil if not found
+func (r *TenantRegistry) lookupSite(site string) *Tenant {
+	for _, t := range r.bySite[HashStringKeyed(site)] {
+		if t.site == site {
+			return t
+		}
+	}
+	return nil
+}
+
+// Lookup returns the tenant for any URL on a website, or the default tenant (if any) if not found
+func (r *TenantRegistry) Lookup(websiteURL string) *Tenant {
+	if t := r.lookupSite(siteKey(websiteURL)); t != nil {
+		return t
+	}
+	return r.defaultTenant
+}
+
+// LookupName returns the tenant with the given name, or nil if not found
+func (r *TenantRegistry) LookupName(name string) *Tenant {
+	return r.byName[name]
+}
+
+// Tenants returns all tenants in the order configured
+func (r *TenantRegistry) Tenants() []*Tenant {
+	return r.tenants
+}
+
+// Reload reloads the form schema of every tenant with its own forms.
+// Returns the first error (if any), with the current schema kept for that tenant.
+func (r *TenantRegistry) Reload() error {
+	var first error
+	for _, t := range r.tenants {
+		if t.forms != nil {
+			if err := t.forms.Reload(); err != nil && first == nil {
+				first = fmt.Errorf("tenant %s: %v", t.Name, err)
+			}
+		}
+	}
+	return first
+}
+
+// Close closes all tenant sinks
+func (r *TenantRegistry) Close() error {
+	var first error
+	for _, t := range r.byName {
+		if t.sink != nil {
+			if err := t.sink.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
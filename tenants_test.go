@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTenantRegistry(t *testing.T) {
+	r, err := LoadTenantRegistry(filepath.Join("testdata", "tenants.json"), SinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tests := map[string]string{
+		"https://shop.example.com/index.html":  "shop",
+		"https://SHOP.example.com/basket?id=1": "shop",
+		"http://shop.example.com/index.html":   "local", // different scheme - falls back to the default
+		"http://localhost:8080/index.html":     "local",
+		"http://unknown.com/":                  "local",
+	}
+	for url, name := range tests {
+		if tenant := r.Lookup(url); tenant == nil || tenant.Name != name {
+			t.Errorf("Unexpected tenant for %s: expected %s, got %+v", url, name, tenant)
+		}
+	}
+	if tenant := r.LookupName("shop"); tenant == nil || tenant.forms == nil || tenant.forms.Schema().Form("signup") == nil {
+		t.Errorf("Tenant forms not loaded: %+v", tenant)
+	}
+}
+
+func TestTenantRegistryErrors(t *testing.T) {
+	tests := []struct {
+		configs  []TenantConfig
+		expected string
+	}{
+		{[]TenantConfig{{WebsiteURL: "http://a.com"}}, "tenant with no name"},
+		{[]TenantConfig{{Name: "a", WebsiteURL: "a.com"}}, "invalid website URL for tenant a"},
+		{[]TenantConfig{{Name: "a", WebsiteURL: "http://a.com"}, {Name: "a", WebsiteURL: "http://b.com"}}, "duplicate tenant name: a"},
+		{[]TenantConfig{{Name: "a", WebsiteURL: "http://a.com"}, {Name: "b", WebsiteURL: "http://A.com/"}}, "duplicate website URL for tenant b"},
+		{[]TenantConfig{{Name: "a", WebsiteURL: "http://a.com", Default: true}, {Name: "b", WebsiteURL: "http://b.com", Default: true}}, "more than one default tenant"},
+		{[]TenantConfig{{Name: "a", WebsiteURL: "http://a.com", Sinks: []string{"ftp://a.com"}}}, "tenant a: unknown event sink"},
+		{[]TenantConfig{{Name: "a", WebsiteURL: "http://a.com", Forms: "testdata/none.json"}}, "tenant a: open testdata/none.json"},
+	}
+	for _, test := range tests {
+		if _, err := CreateTenantRegistry(test.configs, SinkConfig{}); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Unexpected error for %+v: expected %q, got %v", test.configs, test.expected, err)
+		}
+	}
+}
+
+func TestTenantAuthorize(t *testing.T) {
+	r, err := LoadTenantRegistry(filepath.Join("testdata", "tenants.json"), SinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shop := r.LookupName("shop")
+	local := r.LookupName("local")
+
+	tests := []struct {
+		tenant  *Tenant
+		apiKey  string
+		origin  string
+		allowed bool
+	}{
+		{shop, "shop-site-key", "", true},
+		{shop, "shop-site-key", "https://checkout.example.com", true},
+		{shop, "shop-site-key", "https://evil.example.com", false},
+		{shop, "wrong", "https://shop.example.com", false},
+		{shop, "", "", false},
+		{local, "", "http://localhost:8080", true},
+		{local, "", "http://localhost:9090", false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "http://localhost/api", nil)
+		if len(test.apiKey) > 0 {
+			request.Header.Set(apiKeyHeader, test.apiKey)
+		}
+		if len(test.origin) > 0 {
+			request.Header.Set("Origin", test.origin)
+		}
+		if err := test.tenant.authorize(request); (err == nil) != test.allowed {
+			t.Errorf("Unexpected authorisation for tenant %s (key %q, origin %q): %v", test.tenant.Name, test.apiKey, test.origin, err)
+		}
+	}
+}
+
+func TestServerTenants(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shopOut := filepath.Join(dir, "shop.log")
+
+	tenants, err := CreateTenantRegistry([]TenantConfig{
+		{Name: "shop", WebsiteURL: "https://shop.example.com", APIKey: "key", Sinks: []string{"file:" + shopOut}},
+		{Name: "blog", WebsiteURL: "https://blog.example.com"},
+	}, SinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := CreateSessionManager()
+	server := &Server{sessionMgr: sm, tenants: tenants}
+	server.Init()
+
+	// page loads are for the tenant of the requested host
+	response := httptest.NewRecorder()
+	server.defaultHandler(response, httptest.NewRequest("GET", "https://shop.example.com/index.html", nil))
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `value="key"`) {
+		t.Fatalf("Failed to load tenant page: %d", response.Code)
+	}
+	response = httptest.NewRecorder()
+	server.defaultHandler(response, httptest.NewRequest("GET", "https://other.example.com/index.html", nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status for unknown tenant page: %d", response.Code)
+	}
+
+	shopData, _ := sm.NewSession()
+	shopData.Tenant = "shop"
+	postEvent := func(websiteURL string, apiKey string) int {
+		request := httptest.NewRequest("POST", "http://localhost/api", strings.NewReader(
+			`{"eventType":"timeTaken","time":5,"websiteUrl":"`+websiteURL+`","sessionId":"`+shopData.SessionID+`"}`))
+		request.Header.Set(apiKeyHeader, apiKey)
+		response := httptest.NewRecorder()
+		server.apiHandler(response, request)
+		return response.Code
+	}
+
+	if status := postEvent("https://shop.example.com/index.html", "key"); status != http.StatusOK {
+		t.Errorf("Unexpected status for tenant event: %d", status)
+	}
+	if status := postEvent("https://shop.example.com/index.html", "bad"); status != http.StatusForbidden {
+		t.Errorf("Unexpected status for event with wrong site key: %d", status)
+	}
+	if status := postEvent("https://blog.example.com/index.html", ""); status != http.StatusForbidden {
+		t.Errorf("Unexpected status for event to another tenant's session: %d", status)
+	}
+	if status := postEvent("https://other.example.com/index.html", ""); status != http.StatusForbidden {
+		t.Errorf("Unexpected status for event for unknown tenant: %d", status)
+	}
+
+	expected := TenantCounters{Sessions: 1, Events: 1, Rejected: 1}
+	if counters := tenants.LookupName("shop").Counters(); counters != expected {
+		t.Errorf("Unexpected shop counters: expected %+v, got %+v", expected, counters)
+	}
+	if counters := tenants.LookupName("blog").Counters(); counters != (TenantCounters{Rejected: 1}) {
+		t.Errorf("Unexpected blog counters: %+v", counters)
+	}
+
+	// output goes to the tenant's own sink
+	tenants.Close()
+	if out, err := ioutil.ReadFile(shopOut); err != nil || !strings.Contains(string(out), "FormCompletionTime: 5 seconds") {
+		t.Errorf("Tenant output not written: %s (%v)", out, err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	dftTLSPort         = 443                 // default listening port when serving HTTPS
+	selfSignedLifetime = 30 * 24 * time.Hour // validity of generated development certificates
+)
+
+// selfSignedHosts are the names a generated development certificate is valid for
+var selfSignedHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// newTLSConfig returns our TLS configuration for a certificate, offering HTTP/2 to clients that support it
+func newTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+}
+
+// LoadTLSConfig returns a TLS configuration using the PEM encoded certificate and key files given
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return newTLSConfig(cert), nil
+}
+
+// SelfSignedTLSConfig returns a TLS configuration using a newly generated self-signed certificate
+// for the hosts given. This is only intended for local development - browsers will warn about it.
+func SelfSignedTLSConfig(hosts []string) (*tls.Config, error) {
+	certPEM, keyPEM, err := generateSelfSignedCert(hosts, timeNow())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return newTLSConfig(cert), nil
+}
+
+// generateSelfSignedCert returns a PEM encoded certificate and key for the hosts (names or IP addresses)
+// given, valid from now for selfSignedLifetime
+func generateSelfSignedCert(hosts []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"go-codetest development"}},
+		NotBefore:             now.Add(-time.Hour), // allow for clock skew
+		NotAfter:              now.Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// redirectToHTTPS returns a handler redirecting every request to the same URL using HTTPS on the port given.
+// 308 is used so clients repeat POSTs to the new URL rather than changing them to GETs.
+func redirectToHTTPS(port uint) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host // no port given
+		}
+		if port != dftTLSPort {
+			host = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		target := fmt.Sprintf("https://%s%s", host, request.URL.RequestURI())
+		http.Redirect(response, request, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testCertPool returns a pool trusting the certificate in a TLS configuration
+func testCertPool(t *testing.T, config *tls.Config) *x509.CertPool {
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return pool
+}
+
+func TestSelfSignedTLSConfig(t *testing.T) {
+	config, err := SelfSignedTLSConfig(selfSignedHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || len(config.NextProtos) == 0 || config.NextProtos[0] != "h2" {
+		t.Errorf("Unexpected TLS config: %+v", config)
+	}
+
+	leaf, _ := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	pool := testCertPool(t, config)
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+			t.Errorf("Certificate not valid for %s: %v", host, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: pool}); err == nil {
+		t.Errorf("Certificate valid for example.com")
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM, err := generateSelfSignedCert([]string{"localhost"}, timeNow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+
+	if config, err := LoadTLSConfig(certFile, keyFile); err != nil || len(config.Certificates) != 1 {
+		t.Errorf("Failed to load TLS config: %v", err)
+	}
+	if _, err := LoadTLSConfig(certFile, certFile); err == nil {
+		t.Errorf("Loaded TLS config with no private key")
+	}
+	if _, err := LoadTLSConfig(filepath.Join(dir, "none.pem"), keyFile); err == nil {
+		t.Errorf("Loaded TLS config from missing file")
+	}
+}
+
+func TestTLSConfigServesHTTP2(t *testing.T) {
+	config, err := SelfSignedTLSConfig(selfSignedHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		TLSConfig: config,
+		Handler:   http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: testCertPool(t, config)},
+		ForceAttemptHTTP2: true,
+	}}
+	response, err := client.Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", response.Proto)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port     uint
+		url      string
+		expected string
+	}{
+		{443, "http://localhost/index.html", "https://localhost/index.html"},
+		{443, "http://localhost:8080/index.html?a=b", "https://localhost/index.html?a=b"},
+		{8443, "http://localhost:8080/api", "https://localhost:8443/api"},
+		{8443, "http://[::1]:8080/", "https://[::1]:8443/"},
+		{443, "http://[::1]:8080/", "https://[::1]/"},
+	}
+	for _, test := range tests {
+		response := httptest.NewRecorder()
+		redirectToHTTPS(test.port).ServeHTTP(response, httptest.NewRequest("POST", test.url, nil))
+		if response.Code != http.StatusPermanentRedirect || response.Header().Get("Location") != test.expected {
+			t.Errorf("Unexpected redirect for %s: expected %s, got %d %s", test.url, test.expected,
+				response.Code, response.Header().Get("Location"))
+		}
+	}
+}
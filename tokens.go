@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	tokenVersion    = 1
+	tokenNonceSize  = 16
+	tokenMACSize    = sha256.Size
+	tokenHeaderSize = 1 + 8 + 4 // version, issue time (unix seconds) and website hash
+	tokenSize       = tokenHeaderSize + tokenNonceSize + tokenMACSize
+	tokenClockSkew  = time.Minute // how far in the future an issue time may be before we reject the token
+	tokenKeySize    = 32          // size of generated signing keys
+)
+
+var (
+	// tokenEncoding encodes tokens, rejecting any with unused bits set so each token has only one encoding
+	tokenEncoding = base64.RawURLEncoding.Strict()
+
+	// ErrTokenInvalid is returned for a session token we never issued (malformed, or with a bad signature)
+	ErrTokenInvalid = errors.New("session token not issued by this server")
+	// ErrTokenExpired is returned for a genuine session token which is older than the maximum session lifetime
+	ErrTokenExpired = errors.New("session token expired")
+	// ErrTokenWrongWebsite is returned for a genuine session token used for a website it wasn't issued for
+	ErrTokenWrongWebsite = errors.New("session token issued for another website")
+)
+
+// SessionToken is the content of a signed session token.
+// Tokens are used as session IDs, so we can check a session ID is one we issued (and when, and for which
+// website) before looking up the session. Each token is encoded as unpadded URL safe base64 of:
+//
+//	version		- 1 byte (tokenVersion)
+//	issued		- 8 bytes, big endian unix seconds
+//	website		- 4 bytes, big endian HashString of the website's siteHost
+//	nonce		- 16 random bytes, so every token is unique
+//	signature	- 32 bytes, HMAC-SHA256 of all the above
+type SessionToken struct {
+	Issued      time.Time
+	WebsiteHash uint32
+}
+
+// TokenSigner issues and verifies session tokens signed with a secret key
+type TokenSigner struct {
+	key    []byte
+	maxAge time.Duration // tokens issued longer ago than this are expired (0 for no limit)
+}
+
+// NewTokenSigner returns a signer using the key given, or a random key if none is given
+// (in which case tokens are no longer valid once we restart).
+// Tokens issued more than maxAge ago are rejected as expired (0 for no limit).
+func NewTokenSigner(key []byte, maxAge time.Duration) (*TokenSigner, error) {
+	if len(key) == 0 {
+		key = make([]byte, tokenKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &TokenSigner{key: key, maxAge: maxAge}, nil
+}
+
+// loadSessionKey returns the session key held in the file at path, first creating the file with a new
+// random key if it doesn't exist
+func loadSessionKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		random := make([]byte, tokenKeySize)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		key = []byte(hex.EncodeToString(random))
+		err = ioutil.WriteFile(path, append(key, '\n'), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key = bytes.TrimSpace(key); len(key) == 0 {
+		return nil, fmt.Errorf("session key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// sign returns the signature of a token's content
+func (s *TokenSigner) sign(content []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+// siteHost returns the host name of a website URL in canonical form, or "" if it doesn't have one.
+// Tokens are bound to the host alone as the page may be served to us over plain HTTP by a proxy
+// terminating TLS, while its events carry the https URL the browser sees.
+func siteHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || len(u.Hostname()) == 0 {
+		return ""
+	}
+	return canonicalHost("", u.Hostname())
+}
+
+// Issue returns a new session token for a page on the website given
+func (s *TokenSigner) Issue(website string) (string, error) {
+	token := make([]byte, tokenHeaderSize+tokenNonceSize, tokenSize)
+	token[0] = tokenVersion
+	binary.BigEndian.PutUint64(token[1:9], uint64(timeNow().Unix()))
+	binary.BigEndian.PutUint32(token[9:13], HashString(siteHost(website)))
+	if _, err := rand.Read(token[tokenHeaderSize:]); err != nil {
+		return "", err
+	}
+	token = append(token, s.sign(token)...)
+	return tokenEncoding.EncodeToString(token), nil
+}
+
+// Parse checks a token was issued by us and returns its content, without checking its age or website
+func (s *TokenSigner) Parse(token string) (*SessionToken, error) {
+	b, err := tokenEncoding.DecodeString(token)
+	if err != nil || len(b) != tokenSize || b[0] != tokenVersion {
+		return nil, ErrTokenInvalid
+	}
+	content, signature := b[:tokenSize-tokenMACSize], b[tokenSize-tokenMACSize:]
+	if !hmac.Equal(signature, s.sign(content)) {
+		return nil, ErrTokenInvalid
+	}
+	return &SessionToken{
+		Issued:      time.Unix(int64(binary.BigEndian.Uint64(b[1:9])), 0),
+		WebsiteHash: binary.BigEndian.Uint32(b[9:13]),
+	}, nil
+}
+
+// Verify checks a token was issued by us, for the website given, and hasn't expired.
+// Returns ErrTokenInvalid, ErrTokenWrongWebsite or ErrTokenExpired if not.
+func (s *TokenSigner) Verify(token, website string) (*SessionToken, error) {
+	t, err := s.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	age := timeNow().Sub(t.Issued)
+	if age < -tokenClockSkew {
+		return nil, ErrTokenInvalid // we can't have issued this (unless our clock has gone backwards)
+	}
+	if t.WebsiteHash != HashString(siteHost(website)) {
+		return nil, ErrTokenWrongWebsite
+	}
+	if s.maxAge > 0 && age > s.maxAge {
+		return nil, ErrTokenExpired
+	}
+	return t, nil
+}
+
+// tokenRejectReason returns the reason a session was rejected, as reported in our metrics
+func tokenRejectReason(err error) string {
+	switch err {
+	case ErrTokenExpired:
+		return "expired"
+	case ErrTokenWrongWebsite:
+		return "wrong_website"
+	}
+	return "invalid"
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSigner(t *testing.T) {
+	now := time.Date(2017, 3, 4, 10, 11, 12, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	signer, _ := NewTokenSigner([]byte("secret"), time.Hour)
+	token, err := signer.Issue("https://shop.example.com/checkout?step=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := signer.Issue("https://shop.example.com/checkout?step=2"); other == token {
+		t.Errorf("Same token issued twice: %s", token)
+	}
+	st, err := signer.Verify(token, "HTTPS://Shop.Example.com/basket")
+	if err != nil {
+		t.Fatalf("Failed to verify token: %v", err)
+	}
+	if !st.Issued.Equal(now) || st.WebsiteHash != HashString("shop.example.com") {
+		t.Errorf("Unexpected token content: %+v", st)
+	}
+
+	// flip one bit in every byte of the token in turn
+	raw := []byte(token)
+	for i := range raw {
+		tampered := append([]byte{}, raw...)
+		tampered[i] ^= 1
+		if _, err := signer.Verify(string(tampered), "https://shop.example.com"); err != ErrTokenInvalid {
+			t.Errorf("Tampered token at %d not rejected as invalid: %v", i, err)
+		}
+	}
+
+	otherKey, _ := NewTokenSigner([]byte("another secret"), time.Hour)
+	randomKey, _ := NewTokenSigner(nil, time.Hour)
+	forever, _ := NewTokenSigner([]byte("secret"), 0)
+	tests := []struct {
+		signer   *TokenSigner
+		token    string
+		website  string
+		age      time.Duration
+		expected error
+	}{
+		{signer, token, "https://shop.example.com", 59 * time.Minute, nil},
+		{signer, token, "https://shop.example.com", 61 * time.Minute, ErrTokenExpired},
+		{forever, token, "https://shop.example.com", 1000 * time.Hour, nil},
+		{signer, token, "https://shop.example.com", -30 * time.Second, nil},
+		{signer, token, "https://shop.example.com", -2 * time.Minute, ErrTokenInvalid},
+		{signer, token, "http://shop.example.com:8443/", 0, nil}, // only the host is checked
+		{signer, token, "https://blog.example.com", 0, ErrTokenWrongWebsite},
+		{signer, token, "", 0, ErrTokenWrongWebsite},
+		{signer, token, "https://shop.example.com", 0, nil},
+		{otherKey, token, "https://shop.example.com", 0, ErrTokenInvalid},
+		{randomKey, token, "https://shop.example.com", 0, ErrTokenInvalid},
+		{signer, "", "https://shop.example.com", 0, ErrTokenInvalid},
+		{signer, testSessionID, "https://shop.example.com", 0, ErrTokenInvalid},
+		{signer, token[:len(token)-2], "https://shop.example.com", 0, ErrTokenInvalid},
+		{signer, token + "AA", "https://shop.example.com", 0, ErrTokenInvalid},
+	}
+	issued := now
+	for i, test := range tests {
+		now = issued.Add(test.age)
+		if _, err := test.signer.Verify(test.token, test.website); err != test.expected {
+			t.Errorf("Unexpected result verifying token %d: expected %v, got %v", i, test.expected, err)
+		}
+	}
+}
+
+func TestLoadSessionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessionkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.log.key")
+
+	// a new key is created on first use, and the same key is loaded after a restart
+	key, err := loadSessionKey(path)
+	if err != nil || len(key) != 2*tokenKeySize {
+		t.Fatalf("Failed to create session key: %q, %v", key, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected session key file: %v, %v", info, err)
+	}
+	if loaded, err := loadSessionKey(path); err != nil || !bytes.Equal(loaded, key) {
+		t.Errorf("Session key not reloaded, expected %q, got %q (%v)", key, loaded, err)
+	}
+	signer, _ := NewTokenSigner(key, 0)
+	token, _ := signer.Issue("https://shop.example.com")
+	restarted, _ := NewTokenSigner(key, 0)
+	if _, err := restarted.Verify(token, "https://shop.example.com"); err != nil {
+		t.Errorf("Token rejected after a restart: %v", err)
+	}
+
+	ioutil.WriteFile(path, []byte(" my secret\n"), 0600)
+	if loaded, err := loadSessionKey(path); err != nil || string(loaded) != "my secret" {
+		t.Errorf("Unexpected session key: %q (%v)", loaded, err)
+	}
+	ioutil.WriteFile(path, []byte("\n"), 0600)
+	if _, err := loadSessionKey(path); err == nil {
+		t.Errorf("Expected error for empty session key file")
+	}
+	if _, err := loadSessionKey(filepath.Join(dir, "missing", "sessions.key")); err == nil {
+		t.Errorf("Expected error creating session key in missing directory")
+	}
+}
+
+func TestServerSessionTokens(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stdout)
+
+	tokens, _ := NewTokenSigner([]byte("secret"), time.Hour)
+	sessionMgr := CreateSessionManager()
+	server := &Server{sessionMgr: sessionMgr, metrics: NewMetrics(), tokens: tokens}
+	server.Init()
+	handler := server.Handler()
+	request := func(method, url, contentType, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response.Code
+	}
+	event := func(sid string) string {
+		return `{"eventType":"timeTaken","time":5,"sessionId":"` + sid + `","websiteUrl":"http://localhost/index.html"}`
+	}
+	// the page is served over plain HTTP by a proxy terminating TLS, so the browser sees an https URL
+	secureEvent := func(sid string) string {
+		return strings.Replace(event(sid), "http:", "https:", 1)
+	}
+
+	// the page is served with a signed session ID
+	if status := request("GET", "http://localhost/index.html", "", ""); status != http.StatusOK {
+		t.Fatalf("Unexpected status getting page: %d", status)
+	}
+	sessions := sessionMgr.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Unexpected number of sessions: %d", len(sessions))
+	}
+	sid := sessions[0].Data.SessionID
+	if _, err := tokens.Verify(sid, "http://localhost"); err != nil {
+		t.Fatalf("Session ID is not a valid token: %s: %v", sid, err)
+	}
+
+	if status := request("POST", "http://localhost/api", "", event(sid)); status != http.StatusOK {
+		t.Errorf("Unexpected status posting event: %d", status)
+	}
+	if status := request("POST", "http://localhost/api", "", secureEvent(sid)); status != http.StatusOK {
+		t.Errorf("Unexpected status posting event from https page: %d", status)
+	}
+	forged, _ := NewTokenSigner([]byte("guess"), time.Hour)
+	forgedID, _ := forged.Issue("http://localhost")
+	if status := request("POST", "http://localhost/api", "", event(forgedID)); status != http.StatusForbidden {
+		t.Errorf("Unexpected status posting event with forged session ID: %d", status)
+	}
+	if status := request("POST", "http://localhost/api", "", strings.Replace(event(sid), "localhost", "example.com", 1)); status != http.StatusForbidden {
+		t.Errorf("Unexpected status posting event for another website: %d", status)
+	}
+	if status := request("POST", "http://localhost/index.html", "application/x-www-form-urlencoded",
+		sessionIDControl+"="+sid); status != http.StatusCreated {
+		t.Errorf("Unexpected status posting form: %d", status)
+	}
+	// once the form is posted, the session has ended
+	if status := request("POST", "http://localhost/api", "", event(sid)); status != http.StatusForbidden {
+		t.Errorf("Unexpected status posting event after form: %d", status)
+	}
+	if status := request("POST", "http://localhost/api/batch", "", "["+event(forgedID)+"]"); status != http.StatusOK {
+		t.Errorf("Unexpected status posting batch: %d", status)
+	}
+
+	if !strings.Contains(logged.String(), "Session ID rejected (session token not issued by this server): "+forgedID) ||
+		!strings.Contains(logged.String(), "Session ID rejected (session token issued for another website): "+sid) ||
+		!strings.Contains(logged.String(), "Expired session ID recieved: "+sid) {
+		t.Errorf("Rejected sessions not logged:\n%s", logged.String())
+	}
+	response := httptest.NewRecorder()
+	server.metricsHandler(response, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+	metrics, _ := ioutil.ReadAll(response.Body)
+	for _, expected := range []string{
+		`codetest_sessions_rejected_total{reason="expired"} 1`,
+		`codetest_sessions_rejected_total{reason="invalid"} 2`,
+		`codetest_sessions_rejected_total{reason="wrong_website"} 1`,
+	} {
+		if !regexp.MustCompile("(?m)^" + regexp.QuoteMeta(expected) + "$").Match(metrics) {
+			t.Errorf("Missing metric %s in:\n%s", expected, metrics)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// xxHash64 (https://github.com/Cyan4973/xxHash) processes 32 bytes at a time in four independent lanes,
+// so is faster still than MurmurHash3 for long strings. Partial blocks are buffered between writes.
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 type implements the standard hash.Hash64 interface using xxHash64
+type XXHash64 struct {
+	seed           uint64
+	v1, v2, v3, v4 uint64   // lane accumulators
+	length         int      // total bytes written
+	buf            [32]byte // partial block
+	n              int      // bytes in buf
+}
+
+// CreateXXHash64 creates a new Hash64 implementation of xxHash64 with the given seed
+func CreateXXHash64(seed uint64) hash.Hash64 {
+	h := &XXHash64{seed: seed}
+	h.Reset()
+	return h
+}
+
+// xxRound mixes 8 bytes of input into a lane accumulator
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+// xxMergeRound mixes a lane accumulator into the hash code
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// blocks mixes each whole block of b into the lanes, returning any remaining bytes
+func (h *XXHash64) blocks(b []byte) []byte {
+	v1, v2, v3, v4 := h.v1, h.v2, h.v3, h.v4
+	for ; len(b) >= 32; b = b[32:] {
+		v1 = xxRound(v1, binary.LittleEndian.Uint64(b))
+		v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+		v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+		v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+	}
+	h.v1, h.v2, h.v3, h.v4 = v1, v2, v3, v4
+	return b
+}
+
+// Write takes a sequence of bytes to hash and accumulates the hash code
+// Returns the number of bytes processed (all of them)
+func (h *XXHash64) Write(b []byte) (int, error) {
+	length := len(b)
+	h.length += length
+	if h.n > 0 {
+		copied := copy(h.buf[h.n:], b)
+		h.n += copied
+		b = b[copied:]
+		if h.n < len(h.buf) {
+			return length, nil
+		}
+		h.blocks(h.buf[:])
+		h.n = 0
+	}
+	h.n = copy(h.buf[:], h.blocks(b))
+	return length, nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *XXHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+// Reset resets the Hash to its initial state.
+func (h *XXHash64) Reset() {
+	h.v1 = h.seed + xxPrime1 + xxPrime2
+	h.v2 = h.seed + xxPrime2
+	h.v3 = h.seed
+	h.v4 = h.seed - xxPrime1
+	h.length = 0
+	h.n = 0
+}
+
+// Size returns the number of bytes Sum will return.
+func (h *XXHash64) Size() int {
+	return 8
+}
+
+// BlockSize returns the hash's underlying block size.
+func (h *XXHash64) BlockSize() int {
+	return 32
+}
+
+// Sum64 returns the hash code
+func (h *XXHash64) Sum64() uint64 {
+	var h64 uint64
+	if h.length >= 32 {
+		h64 = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) +
+			bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		h64 = xxMergeRound(h64, h.v1)
+		h64 = xxMergeRound(h64, h.v2)
+		h64 = xxMergeRound(h64, h.v3)
+		h64 = xxMergeRound(h64, h.v4)
+	} else {
+		h64 = h.seed + xxPrime5
+	}
+	h64 += uint64(h.length)
+
+	tail := h.buf[:h.n]
+	for ; len(tail) >= 8; tail = tail[8:] {
+		h64 ^= xxRound(0, binary.LittleEndian.Uint64(tail))
+		h64 = bits.RotateLeft64(h64, 27)*xxPrime1 + xxPrime4
+	}
+	if len(tail) >= 4 {
+		h64 ^= uint64(binary.LittleEndian.Uint32(tail)) * xxPrime1
+		h64 = bits.RotateLeft64(h64, 23)*xxPrime2 + xxPrime3
+		tail = tail[4:]
+	}
+	for _, b := range tail {
+		h64 ^= uint64(b) * xxPrime5
+		h64 = bits.RotateLeft64(h64, 11) * xxPrime1
+	}
+
+	h64 ^= h64 >> 33
+	h64 *= xxPrime2
+	h64 ^= h64 >> 29
+	h64 *= xxPrime3
+	h64 ^= h64 >> 32
+	return h64
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+// published xxHash64 test vectors
+var xxHash64Vectors = []struct {
+	seed     uint64
+	str      string
+	expected uint64
+}{
+	{0, "", 0xef46db3751d8e999},
+	{0, "a", 0xd24ec4f1a98c6e5b},
+	{0, "as", 0x1c330fb2d66be179},
+	{0, "asd", 0x631c37ce72a97393},
+	{0, "asdf", 0x415872f599cea71e},
+	{0, "abc", 0x44bc2cf5ad770999},
+	{0, "Call me Ishmael. Some years ago--never mind how long precisely-", 0x02a2e85470d6fd96},
+}
+
+func TestXXHash64(t *testing.T) {
+	for _, test := range xxHash64Vectors {
+		h := CreateXXHash64(test.seed)
+		if h.Size() != 8 || h.BlockSize() != 32 {
+			t.Fatalf("Incorrect size %d, block size %d", h.Size(), h.BlockSize())
+		}
+		writeInParts(test.str, h, func(split int) {
+			if h.Sum64() != test.expected {
+				t.Errorf("Incorrect hash code for %q (seed %x, split at %d), expected %016x, got %016x",
+					test.str, test.seed, split, test.expected, h.Sum64())
+			}
+		})
+	}
+}